@@ -0,0 +1,149 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const defaultMaxBatchSize = 1000
+const defaultMaxBatchDelay = 10 * time.Millisecond
+
+// Batch calls fn as part of a batch, like Update, but the writes of
+// concurrent callers are combined into a single transaction, building one
+// segment and updating the root once.  A batch is committed once it has
+// Options.MaxBatchSize calls, or Options.MaxBatchDelay after it started.
+//
+// If fn returns an error, the batch is retried without it, and fn is then
+// called again in a transaction of its own, whose error is returned to this
+// caller alone.  If the batch conflicts with another commit, every fn in it
+// is called again on its own in the same way.  So fn may be called more than
+// once, and must be idempotent.
+// Batch is only useful when called from multiple goroutines.
+//
+// The design follows bolt's DB.Batch (github.com/boltdb/bolt, MIT license).
+func (c *Cellar) Batch(fn func(*Tx) error) error {
+	result := make(chan error, 1)
+
+	c.batchLock.Lock()
+	if c.batch == nil || len(c.batch.calls) >= c.maxBatchSize() {
+		b := &batch{
+			cellar: c,
+		}
+		b.timer = time.AfterFunc(c.maxBatchDelay(), b.trigger)
+		c.batch = b
+	}
+	c.batch.calls = append(c.batch.calls, batchCall{fn: fn, result: result})
+	if len(c.batch.calls) >= c.maxBatchSize() {
+		// full, no need to wait for the timer
+		go c.batch.trigger()
+	}
+	c.batchLock.Unlock()
+
+	err := <-result
+	if err == errRunAlone {
+		err = c.Update(fn)
+	}
+	return err
+}
+
+func (c *Cellar) maxBatchSize() int {
+	if c.options.MaxBatchSize <= 0 {
+		return defaultMaxBatchSize
+	}
+	return c.options.MaxBatchSize
+}
+
+func (c *Cellar) maxBatchDelay() time.Duration {
+	if c.options.MaxBatchDelay <= 0 {
+		return defaultMaxBatchDelay
+	}
+	return c.options.MaxBatchDelay
+}
+
+type batchCall struct {
+	fn     func(*Tx) error
+	result chan<- error
+}
+
+type batch struct {
+	cellar *Cellar
+	timer  *time.Timer
+	once   sync.Once
+	calls  []batchCall
+}
+
+// trigger runs the batch, the first time it is called
+func (b *batch) trigger() {
+	b.once.Do(b.run)
+}
+
+// run commits the calls of the batch in one transaction, and sends each
+// caller its result.  A call whose fn fails is dropped, and the rest are
+// committed without it
+func (b *batch) run() {
+	b.cellar.batchLock.Lock()
+	b.timer.Stop()
+	// no more calls can join, a full batch may already have been replaced
+	if b.cellar.batch == b {
+		b.cellar.batch = nil
+	}
+	b.cellar.batchLock.Unlock()
+
+	calls := b.calls
+	for len(calls) > 0 {
+		failed := -1
+		err := b.cellar.Update(func(tx *Tx) error {
+			for i, call := range calls {
+				err := callBatchFn(call.fn, tx)
+				if err != nil {
+					failed = i
+					return err
+				}
+			}
+			return nil
+		})
+		if failed >= 0 {
+			calls[failed].result <- errRunAlone
+			calls = append(calls[:failed], calls[failed+1:]...)
+			continue
+		}
+		if err == ErrTxConflict {
+			// any one of the calls may have caused the conflict, each finds
+			// out for itself, rather than failing callers which didn't
+			err = errRunAlone
+		}
+		for _, call := range calls {
+			call.result <- err
+		}
+		return
+	}
+}
+
+// errRunAlone tells a caller of Batch to call its fn in a transaction of its
+// own, it is never returned from Batch
+var errRunAlone = errors.New("batch call must be run alone")
+
+// callBatchFn calls fn, turning a panic into an error, so that one caller
+// can't take down the rest of the batch
+func callBatchFn(fn func(*Tx) error, tx *Tx) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = fmt.Errorf("batch function panicked: %v", p)
+		}
+	}()
+	return fn(tx)
+}
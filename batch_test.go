@@ -0,0 +1,177 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBatch(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	options := *testOptionsNoAutoMerge
+	options.MaxBatchDelay = 100 * time.Millisecond
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n := 50
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = c.Batch(func(tx *Tx) error {
+				if i == 7 {
+					err := tx.Put([]byte("bad"), []byte("bad"))
+					if err != nil {
+						return err
+					}
+					return fmt.Errorf("fail %d", i)
+				}
+				return putKvPairs(tx, i, i+1)
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if i == 7 {
+			if err == nil || !strings.Contains(err.Error(), "fail 7") {
+				t.Errorf("expected caller 7 to get its own error, got %v", err)
+			}
+		} else if err != nil {
+			t.Errorf("expected caller %d to succeed, got %v", i, err)
+		}
+	}
+
+	// far fewer segments than calls
+	if c.Stats().Segments() >= uint64(n/2) {
+		t.Errorf("expected calls to be batched, got %d segments for %d calls", c.Stats().Segments(), n)
+	}
+
+	c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, "bad")
+		checkNoKey(t, tx, "k0000000000000007")
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k0000000000000031", "v0000000000000031", n-1)
+		return nil
+	})
+}
+
+func TestBatchMaxSize(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	options := *testOptionsNoAutoMerge
+	options.MaxBatchSize = 10
+	// long enough that only full batches are committed during the test
+	options.MaxBatchDelay = time.Minute
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	n := 30
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := c.Batch(func(tx *Tx) error {
+				return putKvPairs(tx, i, i+1)
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if c.Stats().Segments() != 3 {
+		t.Errorf("expected 3 batches of 10, got %d segments", c.Stats().Segments())
+	}
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k000000000000001d", "v000000000000001d", n)
+		return nil
+	})
+}
+
+func TestBatchConflict(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	options := *testOptionsNoAutoMerge
+	options.MaxBatchSize = 2
+	options.MaxBatchDelay = time.Hour
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// the first call reads "a", then waits while another commit writes it,
+	// so the batch conflicts
+	read := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	errs := make([]error, 2)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		errs[0] = c.Batch(func(tx *Tx) error {
+			tx.Get([]byte("a"))
+			once.Do(func() {
+				close(read)
+				<-release
+			})
+			return tx.Put([]byte("b"), []byte("1"))
+		})
+	}()
+	go func() {
+		defer wg.Done()
+		errs[1] = c.Batch(func(tx *Tx) error {
+			return tx.Put([]byte("c"), []byte("1"))
+		})
+	}()
+
+	<-read
+	err = c.Update(func(tx *Tx) error {
+		return tx.Put([]byte("a"), []byte("1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	wg.Wait()
+
+	// each call was run again on its own, without conflicting
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("expected call %d to succeed, got %v", i, err)
+		}
+	}
+	c.View(func(tx *Tx) error {
+		checkKey(t, tx, "a", "1")
+		checkKey(t, tx, "b", "1")
+		checkKey(t, tx, "c", "1")
+		return nil
+	})
+}
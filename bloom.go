@@ -0,0 +1,95 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"math"
+)
+
+var bloomKeyName = []byte("bloom")
+
+// bloomFilter is a bloom filter over the keys of a segment
+// the k probe positions are derived from a single 64-bit hash of the key
+// (Kirsch-Mitzenmacher double hashing)
+type bloomFilter struct {
+	bits []byte
+	k    uint32
+}
+
+func bloomHash(key []byte) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write(key)
+	return h.Sum64()
+}
+
+// newBloomFilter returns a filter sized for n keys at the
+// requested false positive rate
+func newBloomFilter(n int, fpRate float64) *bloomFilter {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2))
+	k := math.Ceil(m / float64(n) * math.Ln2)
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits: make([]byte, (uint64(m)+7)/8),
+		k:    uint32(k),
+	}
+}
+
+func (b *bloomFilter) add(hash uint64) {
+	m := uint64(len(b.bits)) * 8
+	h1, h2 := hash&0xffffffff, hash>>32
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % m
+		b.bits[pos/8] |= 1 << (pos % 8)
+	}
+}
+
+// mayContain returns false only if the key is definitely not in the segment
+func (b *bloomFilter) mayContain(hash uint64) bool {
+	m := uint64(len(b.bits)) * 8
+	h1, h2 := hash&0xffffffff, hash>>32
+	for i := uint64(0); i < uint64(b.k); i++ {
+		pos := (h1 + i*h2) % m
+		if b.bits[pos/8]&(1<<(pos%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) MarshalBinary() (data []byte, err error) {
+	rv := make([]byte, 4+len(b.bits))
+	binary.BigEndian.PutUint32(rv, b.k)
+	copy(rv[4:], b.bits)
+	return rv, nil
+}
+
+func parseBloomFilter(val []byte) (*bloomFilter, error) {
+	if len(val) < 5 {
+		return nil, fmt.Errorf("bloom filter too short: %d bytes", len(val))
+	}
+	rv := &bloomFilter{
+		k:    binary.BigEndian.Uint32(val),
+		bits: make([]byte, len(val)-4),
+	}
+	// copy, the value is only valid for the life of the bolt tx
+	copy(rv.bits, val[4:])
+	return rv, nil
+}
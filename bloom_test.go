@@ -0,0 +1,113 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	filter := newBloomFilter(1000, 0.01)
+	for i := 0; i < 1000; i++ {
+		filter.add(bloomHash([]byte(fmt.Sprintf("k%016x", i))))
+	}
+
+	filterBytes, err := filter.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	filter, err = parseBloomFilter(filterBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no false negatives
+	for i := 0; i < 1000; i++ {
+		if !filter.mayContain(bloomHash([]byte(fmt.Sprintf("k%016x", i)))) {
+			t.Errorf("expected filter to contain key %d", i)
+		}
+	}
+
+	// false positives close to the requested rate
+	falsePositives := 0
+	for i := 1000; i < 11000; i++ {
+		if filter.mayContain(bloomHash([]byte(fmt.Sprintf("k%016x", i)))) {
+			falsePositives++
+		}
+	}
+	if falsePositives > 300 {
+		t.Errorf("expected about 100 false positives out of 10000, got %d", falsePositives)
+	}
+}
+
+func TestCellarBloomFilter(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", &Options{
+		BloomFalsePositiveRate: 0.01,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 0, 100)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		err := putKvPairs(tx, 100, 200)
+		if err != nil {
+			return err
+		}
+		return tx.Delete([]byte("k0000000000000000"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := c.getRoot("TestCellarBloomFilter")
+	for _, segment := range root {
+		if segment.bloom == nil {
+			t.Errorf("expected segment %d to have a bloom filter", segment.seq)
+		}
+		segment.decrRef("test done with refs")
+	}
+
+	c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, "doesnotexist")
+		checkNoKey(t, tx, "k0000000000000000")
+		checkKey(t, tx, "k0000000000000001", "v0000000000000001")
+		checkKey(t, tx, "k00000000000000c7", "v00000000000000c7")
+		return nil
+	})
+}
+
+func TestCellarBloomFalsePositiveRateInvalid(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	for _, rate := range []float64{-0.01, 1, 2, math.NaN()} {
+		c, err := Open("test", &Options{
+			BloomFalsePositiveRate: rate,
+		})
+		if err == nil {
+			_ = c.Close()
+			t.Errorf("expected error opening with false positive rate %v", rate)
+		}
+	}
+}
@@ -13,6 +13,8 @@
 package cellar
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -21,6 +23,7 @@ import (
 	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -35,20 +38,112 @@ const crawlSpaceName = ".crawlspace"
 var masterBucketName = []byte("m")
 var rootKeyName = []byte("root")
 
+// Durability controls what is synced to stable storage before a new segment
+// is made live on the root
+type Durability int
+
+const (
+	// DurabilitySync syncs every new segment file, and the cellar directory
+	// once the segment is renamed into place, before it is recorded on the
+	// root, so the root never references a torn or missing segment after a
+	// crash
+	DurabilitySync Durability = iota
+	// DurabilityNone never syncs segment files.  This is fast but UNSAFE,
+	// after a power loss the root may reference a torn or missing segment.
+	// Only use this for bulk loads which can be redone from scratch.
+	DurabilityNone
+)
+
 // Options let you change configurable behavior within the cellar
 type Options struct {
 	AutomaticMerge bool
+
+	// MergePolicy decides which segments get merged, defaults to
+	// SimpleMergePolicy if nil
+	MergePolicy MergePolicy
+
+	// Durability defaults to DurabilitySync
+	Durability Durability
+
+	// CrawlspaceRetention is applied to the crawlspace every time the cellar
+	// is opened, and by PurgeCrawlspace.  If nil, abandoned segments are
+	// kept in the crawlspace forever
+	CrawlspaceRetention *CrawlspaceRetention
+
+	// BloomFalsePositiveRate is the target false positive rate of the bloom
+	// filter built for each segment, Get skips segments ruled out by the
+	// filter.  0 disables bloom filters for newly built segments, otherwise
+	// it must be less than 1
+	BloomFalsePositiveRate float64
+
+	// MergeWriteRate limits the bytes per second written by merges, across
+	// all merges in progress, so that they do not starve foreground commits
+	// of disk bandwidth.  MergeReadRate does the same for bytes read by
+	// merges.  0 is unlimited, the limits can be changed on an open cellar
+	// with SetMergeWriteRate and SetMergeReadRate
+	MergeWriteRate int64
+	MergeReadRate  int64
+
+	// MergeWorkers is the number of merges which can run at once, 0 uses 2
+	MergeWorkers int
+
+	// MergeQueueDepth is the number of merges chosen by the policy which can
+	// wait for a worker, 0 uses 1024.  When the queue is full, further
+	// merges are dropped until the policy chooses them again, commits are
+	// never held up waiting for the merge workers
+	MergeQueueDepth int
+
+	// MaxBatchSize is the most calls combined into one transaction by
+	// Batch, 0 uses 1000.  MaxBatchDelay is the longest a batch waits for
+	// more calls before it is committed, 0 uses 10ms
+	MaxBatchSize  int
+	MaxBatchDelay time.Duration
+
+	// MergeRetryBackoff is how long a failed background merge waits before
+	// it is retried, doubling with each further failure up to a minute.
+	// 0 uses a second
+	MergeRetryBackoff time.Duration
+
+	// MergeErrorCallback, if set, is called every time a background merge
+	// fails.  It is called from a merge worker, so it should not block
+	MergeErrorCallback func(err *MergeError)
+
+	// MemtableSize enables the memtable, commits are kept in memory and
+	// flushed to a new segment once they add up to this many bytes, instead
+	// of each building a segment.  0 disables the memtable, see memtable.go
+	MemtableSize int64
+
+	// MemtableFlushInterval is the longest a commit stays only in the
+	// memtable before it is flushed, 0 uses a second
+	MemtableFlushInterval time.Duration
 }
 
+const defaultMergeWorkers = 2
+const defaultMergeQueueDepth = 1024
+
 // DefaultOptions give the standard cellar behavior
 var DefaultOptions = &Options{
-	AutomaticMerge: true,
+	AutomaticMerge:         true,
+	BloomFalsePositiveRate: 0.01,
 }
 
 // Cellar is a merged-multi-segment(bolt) k/v store
 type Cellar struct {
-	path   string
-	rwlock sync.Mutex // ONLY used for enforcing single writer
+	path    string
+	options *Options
+
+	// commitLock serializes the validation and publishing of commits
+	// writable transactions otherwise run concurrently, see conflict.go
+	commitLock sync.Mutex
+	commitSeq  uint64
+	// writers maps each open writable Tx to the commitSeq it began after
+	writers map[*Tx]uint64
+	// commits are the keys written by the commits open writers began before
+	commits []commitRecord
+
+	// batch is the batch currently accepting calls, see Batch
+	batchLock sync.Mutex
+	batch     *batch
 
 	seq    uint64
 	master *bolt.DB
@@ -59,6 +154,19 @@ type Cellar struct {
 
 	mergeManager *mergeManager
 
+	mergeWriteLimiter rateLimiter
+	mergeReadLimiter  rateLimiter
+
+	// memtable holds the commits not yet flushed to a segment, guarded by
+	// rootLock, and only replaced while also holding commitLock
+	// nil unless Options.MemtableSize is set, see memtable.go
+	memtable   *memtable
+	wal        *wal
+	flushLock  sync.Mutex
+	flushChan  chan struct{}
+	flushClose chan struct{}
+	flushWG    sync.WaitGroup
+
 	stats Stats
 }
 
@@ -69,6 +177,9 @@ func Open(path string, options *Options) (*Cellar, error) {
 	if options == nil {
 		options = DefaultOptions
 	}
+	if !(options.BloomFalsePositiveRate >= 0 && options.BloomFalsePositiveRate < 1) {
+		return nil, fmt.Errorf("bloom false positive rate must be at least 0 and less than 1, got %v", options.BloomFalsePositiveRate)
+	}
 
 	// make preceeding path elements if necessary
 	err := os.MkdirAll(path, 0700)
@@ -76,20 +187,31 @@ func Open(path string, options *Options) (*Cellar, error) {
 		return nil, err
 	}
 	// make crawlspace
-	err = os.MkdirAll(fmt.Sprintf("%s%s%s", path, string(os.PathSeparator), crawlSpaceName), 0700)
+	err = os.MkdirAll(CrawlspacePath(path), 0700)
 	if err != nil {
 		return nil, err
 	}
 	// map all the segments in this path
 	abandonedSegmentFiles := make(map[string]uint64)
+	tempSegmentFiles := make(map[string]bool)
 	fileInfos, err := ioutil.ReadDir(path)
 	if err != nil {
 		return nil, fmt.Errorf("error reading cellar path entries: %v", err)
 	}
 	for _, fileInfo := range fileInfos {
 		filename := fileInfo.Name()
+		if !strings.HasPrefix(filename, segmentPrefix) {
+			continue
+		}
+		// segments that were never completed have the pattern cellar-0000000000000000.tmp
+		// they are removed once the root is read, unless their seq is on it,
+		// see recoverTempSegment
+		if strings.HasSuffix(filename, segmentTempSuffix) {
+			tempSegmentFiles[filename] = true
+			continue
+		}
 		// segments all have the pattern cellar-0000000000000000
-		if strings.HasPrefix(filename, segmentPrefix) && len(filename) == len(segmentPrefix)+16 {
+		if len(filename) == len(segmentPrefix)+16 {
 			fileseq, err := strconv.ParseUint(filename[len(segmentPrefix):len(segmentPrefix)+16], 16, 64)
 			if err != nil {
 				return nil, fmt.Errorf("error parsing segment filename seq: %v", err)
@@ -105,9 +227,13 @@ func Open(path string, options *Options) (*Cellar, error) {
 	}
 
 	rv := &Cellar{
-		path:   path,
-		master: db,
+		path:    path,
+		options: options,
+		master:  db,
+		writers: make(map[*Tx]uint64),
 	}
+	rv.mergeWriteLimiter.setRate(options.MergeWriteRate)
+	rv.mergeReadLimiter.setRate(options.MergeReadRate)
 
 	// read
 	err = db.Update(func(tx *bolt.Tx) error {
@@ -135,6 +261,14 @@ func Open(path string, options *Options) (*Cellar, error) {
 			}
 			root := make(segmentList, 0)
 			for _, seq := range rootSeqs {
+				tempFilename := segmentFilename(seq) + segmentTempSuffix
+				if tempSegmentFiles[tempFilename] {
+					err = recoverTempSegment(path, seq, options.Durability)
+					if err != nil {
+						return err
+					}
+					delete(tempSegmentFiles, tempFilename)
+				}
 				segment, err := openSegment(path, seq)
 				if err != nil {
 					return err
@@ -154,9 +288,18 @@ func Open(path string, options *Options) (*Cellar, error) {
 		return nil
 	})
 	if err != nil {
+		_ = db.Close()
 		return nil, err
 	}
 
+	for tempFilename := range tempSegmentFiles {
+		err = os.Remove(fmt.Sprintf("%s%s%s", path, string(os.PathSeparator), tempFilename))
+		if err != nil {
+			_ = db.Close()
+			return nil, fmt.Errorf("error removing incomplete segment %s: %v", tempFilename, err)
+		}
+	}
+
 	// anything left in abandonedSegmentFiles will be moved to the crawlspace
 	for abandonedSegment, abandonedSegmentSeq := range abandonedSegmentFiles {
 		// ensure we don't reuse seqs that were abandoned
@@ -165,52 +308,137 @@ func Open(path string, options *Options) (*Cellar, error) {
 		}
 		// move it, again to prevent accidental reuse
 		segmentPath := fmt.Sprintf("%s%s%s", path, string(os.PathSeparator), abandonedSegment)
-		segmentCrawlSpacePath := fmt.Sprintf("%s%s%s%s%s", path, string(os.PathSeparator), crawlSpaceName, string(os.PathSeparator), abandonedSegment)
+		segmentCrawlSpacePath := fmt.Sprintf("%s%s%s", CrawlspacePath(path), string(os.PathSeparator), abandonedSegment)
 		err := os.Rename(segmentPath, segmentCrawlSpacePath)
 		if err != nil {
 			Logger.Printf("error moving segment %s to crawlspace: %v", abandonedSegment, err)
+			continue
+		}
+		// crawlspace retention is based on the time a file entered the crawlspace
+		now := time.Now()
+		err = os.Chtimes(segmentCrawlSpacePath, now, now)
+		if err != nil {
+			Logger.Printf("error touching segment %s in crawlspace: %v", abandonedSegment, err)
 		}
 	}
 
-	rv.mergeManager = newMergeManager(rv, &SimpleMergePolicy{}, options.AutomaticMerge, 2)
+	_, err = rv.PurgeCrawlspace()
+	if err != nil {
+		Logger.Printf("error purging crawlspace: %v", err)
+	}
+
+	var mergePolicy MergePolicy = &SimpleMergePolicy{}
+	if options.MergePolicy != nil {
+		mergePolicy = options.MergePolicy
+	}
+	mergeWorkers := options.MergeWorkers
+	if mergeWorkers <= 0 {
+		mergeWorkers = defaultMergeWorkers
+	}
+	mergeQueueDepth := options.MergeQueueDepth
+	if mergeQueueDepth <= 0 {
+		mergeQueueDepth = defaultMergeQueueDepth
+	}
+	rv.mergeManager = newMergeManager(rv, mergePolicy, options.AutomaticMerge, mergeWorkers, mergeQueueDepth)
 	err = rv.mergeManager.Start()
 	if err != nil {
 		return nil, err
 	}
 
+	// commits left in the write-ahead log by a crash are written to a
+	// segment, even if the memtable is no longer enabled
+	err = rv.replayWAL()
+	if err != nil {
+		_ = rv.Close()
+		return nil, fmt.Errorf("error replaying wal: %v", err)
+	}
+
+	if options.MemtableSize > 0 {
+		rv.wal, err = openWAL(path, options.Durability)
+		if err != nil {
+			_ = rv.Close()
+			return nil, err
+		}
+		flushInterval := options.MemtableFlushInterval
+		if flushInterval <= 0 {
+			flushInterval = defaultMemtableFlushInterval
+		}
+		rv.memtable = &memtable{}
+		rv.flushChan = make(chan struct{}, 1)
+		rv.flushClose = make(chan struct{})
+		rv.flushWG.Add(1)
+		go rv.runFlusher(flushInterval)
+	}
+
 	return rv, nil
 }
 
+// recoverTempSegment renames a temp segment file whose seq is on the root
+// into place.  Build renames a segment before it is recorded on the root, but
+// a crash can lose the rename while the root survives.  The file is complete
+// as Build synced it before the rename
+func recoverTempSegment(path string, seq uint64, durability Durability) error {
+	segmentPath := fmt.Sprintf("%s%s%s", path, string(os.PathSeparator), segmentFilename(seq))
+	_, err := os.Stat(segmentPath)
+	if err == nil {
+		// already in place, the temp file is removed with the others
+		return nil
+	}
+	err = os.Rename(segmentPath+segmentTempSuffix, segmentPath)
+	if err != nil {
+		return fmt.Errorf("error recovering segment %s: %v", segmentFilename(seq), err)
+	}
+	if durability != DurabilityNone {
+		err = syncDir(path)
+		if err != nil {
+			return fmt.Errorf("error recovering segment %s: %v", segmentFilename(seq), err)
+		}
+	}
+	Logger.Printf("recovered segment %s on the root from its temp file", segmentFilename(seq))
+	return nil
+}
+
 // Begin starts a new transaction
 // writable controls whether or not this transaction supports Put/Delete
+// writable transactions may run concurrently, if they conflict, the later
+// to commit fails with ErrTxConflict
 func (c *Cellar) Begin(writable bool) (*Tx, error) {
-
-	var segmentBuilder *segmentBuilder
+	tx := &Tx{
+		cellar:   c,
+		writable: writable,
+	}
+	var mem *memtable
 	if writable {
-		c.rwlock.Lock()
-
-		nextSeq := atomic.AddUint64(&c.seq, 1)
-		var err error
-		segmentBuilder, err = newSegmentBuilder(c.path, nextSeq)
-		if err != nil {
-			return nil, fmt.Errorf("cellar Begin newSegmentBuilder: %v", err)
+		if c.options.MemtableSize > 0 {
+			tx.buffer = newMemBuffer()
+		} else {
+			nextSeq := atomic.AddUint64(&c.seq, 1)
+			var err error
+			tx.segmentBuilder, err = newSegmentBuilder(c.path, nextSeq, c.options)
+			if err != nil {
+				return nil, fmt.Errorf("cellar Begin newSegmentBuilder: %v", err)
+			}
 		}
+		tx.reads = newReadSet()
+		tx.beginSeq, tx.root, mem = c.beginWriter(tx)
+	} else {
+		tx.root, mem = c.getView("cellar begin")
 	}
 
-	root := c.getRoot("cellar begin")
-	reader, err := newReader(root)
+	reader, err := newReader(tx.root)
 	if err != nil {
+		_ = tx.rollback()
 		return nil, fmt.Errorf("cellar Begin newReader: %v", err)
 	}
-
-	return &Tx{
-		cellar:         c,
-		writable:       writable,
-		managed:        false,
-		segmentBuilder: segmentBuilder,
-		root:           root,
-		reader:         reader,
-	}, nil
+	mem.overlay(reader)
+	if tx.buffer != nil {
+		// let this transaction read its own uncommitted writes
+		reader.overlay(tx.buffer)
+	} else if writable {
+		reader.overlay(tx.segmentBuilder.source())
+	}
+	tx.reader = reader
+	return tx, nil
 }
 
 // Close will release all resources associated with the cellar
@@ -219,16 +447,36 @@ func (c *Cellar) Begin(writable bool) (*Tx, error) {
 func (c *Cellar) Close() error {
 	Logger.Printf("cellar closing")
 
+	var err error
+	if c.memtable != nil {
+		// stop the flusher, and flush whatever is left
+		close(c.flushClose)
+		c.flushWG.Wait()
+		err = c.Flush()
+		if err != nil {
+			Logger.Printf("error flushing memtable: %v", err)
+		}
+		// commits append to the wal under commitLock
+		c.commitLock.Lock()
+		werr := c.wal.Close()
+		c.commitLock.Unlock()
+		if werr != nil && err == nil {
+			err = werr
+		}
+	}
+
 	// set master to nil, this signals to stop accepting mutations to root
 	c.rootLock.Lock()
 	master := c.master
 	c.master = nil
 	c.rootLock.Unlock()
 
-	var err error
 	// stop the merger
 	Logger.Printf("telling merge manager to stop")
-	err = c.mergeManager.Stop()
+	serr := c.mergeManager.Stop()
+	if serr != nil && err == nil {
+		err = serr
+	}
 
 	// at this point no one else is racing to change the root, get the final
 	// we don't use getRoot() because that furhter incrs the refs
@@ -259,7 +507,7 @@ func (c *Cellar) Close() error {
 		err = merr
 	}
 
-	return merr
+	return err
 }
 
 // GoString returns the Go string representation of the cellar.
@@ -306,7 +554,10 @@ func (c *Cellar) Update(fn func(*Tx) error) error {
 	}
 
 	err = t.Commit()
-	if err != nil {
+	if err == ErrTxConflict {
+		// returned as is, so the caller can retry
+		return err
+	} else if err != nil {
 		return fmt.Errorf("cellar Update Commit: %v", err)
 	}
 	return nil
@@ -367,7 +618,11 @@ func (c *Cellar) pushRoot(seg *segment) error {
 	// reflects the current root
 	c.rootLock.Lock()
 	defer c.rootLock.Unlock()
+	return c.pushRootLocked(seg)
+}
 
+// pushRootLocked is pushRoot for callers already holding rootLock
+func (c *Cellar) pushRootLocked(seg *segment) error {
 	// check to see if cellar is closed
 	if c.master == nil {
 		return ErrTxClosed
@@ -384,23 +639,24 @@ func (c *Cellar) pushRoot(seg *segment) error {
 	copy(nroot[1:], croot)
 
 	nrootbytes, err := nroot.MarshalBinary()
-	if err != nil {
-		return err
+	if err == nil {
+		// persist the new root to our master database
+		err = c.master.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(masterBucketName)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(rootKeyName, nrootbytes)
+			if err != nil {
+				return err
+			}
+			return nil
+		})
 	}
-
-	// persist the new root to our master database
-	err = c.master.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(masterBucketName)
-		if err != nil {
-			return err
-		}
-		err = bucket.Put(rootKeyName, nrootbytes)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
 	if err != nil {
+		for _, segment := range croot {
+			segment.decrRef("cellar pushRoot failed")
+		}
 		return err
 	}
 
@@ -427,7 +683,7 @@ func (c *Cellar) pushRoot(seg *segment) error {
 	return nil
 }
 
-func (c *Cellar) replaceSegments(replace segmentList, newseg *segment) error {
+func (c *Cellar) replaceSegments(replace segmentList, newsegs segmentList) error {
 	// we need to hold the lock the entire time
 	// because we don't want to ensure our update
 	// reflects the current root
@@ -451,7 +707,7 @@ func (c *Cellar) replaceSegments(replace segmentList, newseg *segment) error {
 			// this is a segment being replaced
 			if replacei == 0 {
 				// this is the first segment being replaced
-				nroot = append(nroot, newseg)
+				nroot = append(nroot, newsegs...)
 			}
 			replacei++
 		} else {
@@ -461,29 +717,32 @@ func (c *Cellar) replaceSegments(replace segmentList, newseg *segment) error {
 	}
 
 	nrootbytes, err := nroot.MarshalBinary()
-	if err != nil {
-		return err
+	if err == nil {
+		// persist the new root to our master database
+		err = c.master.Update(func(tx *bolt.Tx) error {
+			bucket, err := tx.CreateBucketIfNotExists(masterBucketName)
+			if err != nil {
+				return err
+			}
+			err = bucket.Put(rootKeyName, nrootbytes)
+			if err != nil {
+				return err
+			}
+			return nil
+		})
 	}
-
-	// persist the new root to our master database
-	err = c.master.Update(func(tx *bolt.Tx) error {
-		bucket, err := tx.CreateBucketIfNotExists(masterBucketName)
-		if err != nil {
-			return err
-		}
-		err = bucket.Put(rootKeyName, nrootbytes)
-		if err != nil {
-			return err
-		}
-		return nil
-	})
 	if err != nil {
+		for _, segment := range croot {
+			segment.decrRef("cellar replaceSegments failed")
+		}
 		return err
 	}
 
-	// bump the ref count for the new segment
+	// bump the ref count for the new segments
 	// this ensures a segment on the root, always has at least 1 ref
-	newseg.incrRef("on root")
+	for _, newseg := range newsegs {
+		newseg.incrRef("on root")
+	}
 
 	// now update the live root
 	c.root.Store(nroot)
@@ -493,7 +752,7 @@ func (c *Cellar) replaceSegments(replace segmentList, newseg *segment) error {
 		segment.decrRef("cellar replaceSegments")
 	}
 
-	newSegmentCount := uint64(len(croot) - len(replace) + 1)
+	newSegmentCount := uint64(len(croot) - len(replace) + len(newsegs))
 	// increment segment count
 	atomic.StoreUint64(&c.stats.segments, newSegmentCount)
 	atomic.AddUint64(&c.stats.mergesCompleted, 1)
@@ -535,10 +794,131 @@ func (c *Cellar) ForceMerge() {
 	c.mergeManager.ForceMerge(root)
 }
 
+// PauseMerges stops new merges from starting until ResumeMerges is called,
+// whether chosen automatically or by ForceMerge.  Merges already in progress
+// run to completion, use CancelMerges to abort them.  Compact and
+// CompactRange are still allowed while merges are paused.
+func (c *Cellar) PauseMerges() {
+	c.mergeManager.Pause()
+}
+
+// ResumeMerges allows merges to start again after PauseMerges, with
+// automatic merging the merge policy is consulted straight away
+func (c *Cellar) ResumeMerges() {
+	root := c.getRoot("cellar resumeMerges")
+	c.mergeManager.Resume(root)
+}
+
+// CancelMerges aborts every merge in progress, including those started by
+// Compact and CompactRange, which return ErrMergeCanceled.  The partially
+// built segments are removed and the segments being merged are left on the
+// root, to be chosen again by later merges.
+func (c *Cellar) CancelMerges() {
+	c.mergeManager.Cancel()
+}
+
+// compactPollInterval is how often Compact checks whether merges already
+// in progress have finished
+var compactPollInterval = 10 * time.Millisecond
+
+// Compact merges every segment on the root into a single segment, dropping
+// all deletes.  Unlike ForceMerge, it blocks until the merge is done and
+// returns any error which prevented it.  If other merges are in progress,
+// Compact waits for them to finish first, or for the context to be done.
+// If the context is done during the merge, the merge is abandoned as if
+// canceled and the context's error returned.
+// Commits still in the memtable are flushed to a segment first.
+func (c *Cellar) Compact(ctx context.Context) error {
+	err := c.Flush()
+	if err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		root := c.getRoot("cellar compact")
+		if len(root) == 0 || (len(root) == 1 && root[0].deletions == 0) {
+			// already compact
+			for _, segment := range root {
+				segment.decrRef("cellar compact done")
+			}
+			return nil
+		}
+		merge, err := c.mergeManager.Compact(root, root)
+		if err != nil {
+			return err
+		}
+		if merge != nil {
+			merge.ctx = ctx
+			return doMerge(merge)
+		}
+		// some segments are being merged, wait for that to finish
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(compactPollInterval):
+		}
+	}
+}
+
+// CompactRange rewrites only the data for keys in the range [start, end),
+// dropping all deletes of keys in the range.  A nil start or end leaves that
+// side of the range unbounded.  Segments which contain no keys in the range
+// are left untouched, the run of segments which do is merged and the output
+// split into separate segments for keys before, within and after the range,
+// so that later compactions of the range do not rewrite the rest again.
+// Like Compact, it blocks until the merge is done, and flushes the memtable
+// first.  If both start and end are given, start must sort before end, or
+// ErrInvalidRange is returned.
+func (c *Cellar) CompactRange(ctx context.Context, start, end []byte) error {
+	if start != nil && end != nil && bytes.Compare(start, end) >= 0 {
+		return ErrInvalidRange
+	}
+	err := c.Flush()
+	if err != nil {
+		return err
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		root := c.getRoot("cellar compact range")
+		sources := root.overlapping(start, end)
+		if len(sources) == 0 ||
+			(len(sources) == 1 && sources[0].deletions == 0 && sources[0].within(start, end)) {
+			// already compact
+			for _, segment := range root {
+				segment.decrRef("cellar compact range done")
+			}
+			return nil
+		}
+		merge, err := c.mergeManager.Compact(root, sources)
+		if err != nil {
+			return err
+		}
+		if merge != nil {
+			merge.ranged = true
+			merge.start = start
+			merge.end = end
+			merge.ctx = ctx
+			return doMerge(merge)
+		}
+		// some segments are being merged, wait for that to finish
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(compactPollInterval):
+		}
+	}
+}
+
 // Stats returns a structure containing interesting metrics about the cellar
 func (c *Cellar) Stats() *Stats {
 	rv := &Stats{}
 	rv.mergesCompleted = atomic.LoadUint64(&c.stats.mergesCompleted)
 	rv.segments = atomic.LoadUint64(&c.stats.segments)
+	rv.mergeThrottled = atomic.LoadUint64(&c.stats.mergeThrottled)
+	rv.mergesFailed = atomic.LoadUint64(&c.stats.mergesFailed)
 	return rv
 }
@@ -507,3 +507,126 @@ func TestLongevity(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestCellarDurability(t *testing.T) {
+	for _, durability := range []Durability{DurabilitySync, DurabilityNone} {
+		func() {
+			defer os.RemoveAll("test")
+
+			c, err := Open("test", &Options{
+				Durability: durability,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Update(func(tx *Tx) error {
+				return putKvPairs(tx, 0, 100)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c, err = Open("test", &Options{
+				Durability: durability,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			c.View(func(tx *Tx) error {
+				checkKey(t, tx, "k0000000000000000", "v0000000000000000")
+				checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k0000000000000063", "v0000000000000063", 100)
+				return nil
+			})
+		}()
+	}
+}
+
+func TestCellarOpenRemovesTempFiles(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 0, 100)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash while building a segment
+	f, err := os.Create("test/cellar-0000000000000002.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	c, err = Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := os.Stat("test/cellar-0000000000000002.tmp"); err == nil {
+		t.Errorf("expected cellar temp file 'test/cellar-0000000000000002.tmp' to be removed, it exists")
+	}
+	if _, err := os.Stat("test/.crawlspace/cellar-0000000000000002.tmp"); err == nil {
+		t.Errorf("expected cellar temp file to not be moved to the crawlspace, it was")
+	}
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k0000000000000063", "v0000000000000063", 100)
+		return nil
+	})
+}
+
+func TestCellarOpenRecoversTempFileOnRoot(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 0, 100)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash which kept the root, but lost the rename of the segment
+	err = os.Rename("test/cellar-0000000000000001", "test/cellar-0000000000000001.tmp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if _, err := os.Stat("test/cellar-0000000000000001.tmp"); err == nil {
+		t.Errorf("expected cellar temp file 'test/cellar-0000000000000001.tmp' to be renamed, it exists")
+	}
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k0000000000000063", "v0000000000000063", 100)
+		return nil
+	})
+}
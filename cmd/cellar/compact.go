@@ -0,0 +1,65 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/couchbaselabs/cellar"
+)
+
+// compact opens the cellar itself, so it must not be open in another process
+func compact(args []string) {
+	var start, end string
+	flags := flag.NewFlagSet("compact", flag.ExitOnError)
+	flags.StringVar(&start, "start", "", "only compact keys >= this")
+	flags.StringVar(&end, "end", "", "only compact keys < this")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+	path := flags.Arg(0)
+
+	options := *cellar.DefaultOptions
+	options.AutomaticMerge = false
+	c, err := cellar.Open(path, &options)
+	if err != nil {
+		log.Fatalf("error opening cellar: %v", err)
+	}
+
+	if start == "" && end == "" {
+		err = c.Compact(context.Background())
+	} else {
+		var startKey, endKey []byte
+		if start != "" {
+			startKey = []byte(start)
+		}
+		if end != "" {
+			endKey = []byte(end)
+		}
+		err = c.CompactRange(context.Background(), startKey, endKey)
+	}
+	if err != nil {
+		_ = c.Close()
+		log.Fatalf("error compacting cellar: %v", err)
+	}
+
+	err = c.Close()
+	if err != nil {
+		log.Fatalf("error closing cellar: %v", err)
+	}
+	fmt.Printf("compacted %s\n", path)
+}
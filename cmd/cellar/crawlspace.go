@@ -0,0 +1,112 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/couchbaselabs/cellar"
+)
+
+func crawlspace(args []string) {
+	if len(args) < 1 {
+		usage()
+	}
+	switch args[0] {
+	case "list":
+		crawlspaceList(args[1:])
+	case "purge":
+		crawlspacePurge(args[1:])
+	case "restore":
+		crawlspaceRestore(args[1:])
+	default:
+		usage()
+	}
+}
+
+func crawlspaceList(args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+	fileInfos, err := ioutil.ReadDir(cellar.CrawlspacePath(args[0]))
+	if err != nil {
+		log.Fatalf("error reading cellar crawlspace: %v", err)
+	}
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		fmt.Printf("%s\t%d\t%s\n", fileInfo.Name(), fileInfo.Size(), fileInfo.ModTime().Format("2006-01-02T15:04:05Z07:00"))
+	}
+}
+
+func crawlspacePurge(args []string) {
+	var retention cellar.CrawlspaceRetention
+	flags := flag.NewFlagSet("purge", flag.ExitOnError)
+	flags.DurationVar(&retention.MaxAge, "max-age", 0, "purge files older than this")
+	flags.Int64Var(&retention.MaxBytes, "max-bytes", 0, "purge oldest files beyond this many bytes")
+	flags.IntVar(&retention.KeepLast, "keep-last", 0, "purge all but this many newest files")
+	flags.BoolVar(&retention.All, "all", false, "purge every file")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		usage()
+	}
+
+	// never purge everything by accident, that takes -all
+	if retention == (cellar.CrawlspaceRetention{}) {
+		log.Fatalf("no limits given, use -all to purge every file")
+	}
+	purged, err := cellar.PurgeCrawlspace(flags.Arg(0), &retention)
+	for _, name := range purged {
+		fmt.Printf("purged %s\n", name)
+	}
+	if err != nil {
+		log.Fatalf("error purging cellar crawlspace: %v", err)
+	}
+}
+
+func crawlspaceRestore(args []string) {
+	if len(args) != 3 {
+		usage()
+	}
+	src, err := os.Open(filepath.Join(cellar.CrawlspacePath(args[0]), args[1]))
+	if err != nil {
+		log.Fatalf("error opening crawlspace segment: %v", err)
+	}
+	defer src.Close()
+
+	// copy, never move, so the crawlspace is left untouched
+	dest := args[2]
+	if fileInfo, err := os.Stat(dest); err == nil && fileInfo.IsDir() {
+		dest = filepath.Join(dest, args[1])
+	}
+	dst, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatalf("error creating restore destination: %v", err)
+	}
+	_, err = io.Copy(dst, src)
+	if err != nil {
+		log.Fatalf("error copying crawlspace segment: %v", err)
+	}
+	err = dst.Close()
+	if err != nil {
+		log.Fatalf("error closing restore destination: %v", err)
+	}
+	fmt.Printf("restored %s to %s\n", args[1], dest)
+}
@@ -19,6 +19,7 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"os"
 
 	"github.com/boltdb/bolt"
 )
@@ -30,16 +31,50 @@ var readOnly = bolt.Options{
 	ReadOnly: true,
 }
 
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: cellar <path>\n")
+	fmt.Fprintf(os.Stderr, "       cellar crawlspace list <path>\n")
+	fmt.Fprintf(os.Stderr, "       cellar crawlspace purge [-max-age d] [-max-bytes n] [-keep-last n] [-all] <path>\n")
+	fmt.Fprintf(os.Stderr, "       cellar crawlspace restore <path> <segment> <destination>\n")
+	fmt.Fprintf(os.Stderr, "       cellar verify <path>\n")
+	fmt.Fprintf(os.Stderr, "       cellar compact [-start k] [-end k] <path>\n")
+	fmt.Fprintf(os.Stderr, "       cellar stats <url>\n")
+	os.Exit(2)
+}
+
 func main() {
+	flag.Usage = usage
 	flag.Parse()
 
-	cellarPath := flag.Arg(0)
+	switch flag.Arg(0) {
+	case "":
+		usage()
+	case "crawlspace":
+		crawlspace(flag.Args()[1:])
+	case "verify":
+		verify(flag.Args()[1:])
+	case "compact":
+		compact(flag.Args()[1:])
+	case "stats":
+		stats(flag.Args()[1:])
+	default:
+		printRoot(flag.Arg(0))
+	}
+}
+
+func printRoot(cellarPath string) {
+	rootSeqs := readRoot(cellarPath)
+	fmt.Printf("Cellar root sequences: %v\n", rootSeqs)
+}
 
+func readRoot(cellarPath string) []uint64 {
 	db, err := bolt.Open(fmt.Sprintf("%s/%s", cellarPath, "master.db"), 0600, &readOnly)
 	if err != nil {
 		log.Fatalf("error opening cellar master db: %v", err)
 	}
+	defer db.Close()
 
+	var rootSeqs []uint64
 	db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte("m"))
 		if bucket == nil {
@@ -49,14 +84,14 @@ func main() {
 		if root == nil {
 			log.Fatal("celler master bucker does not contain root key 'root'")
 		}
-		rootSeqs, err := parseRoot(root)
+		rootSeqs, err = parseRoot(root)
 		if err != nil {
 			log.Fatalf("error parsing cellar root sequences: %v", err)
 		}
-		fmt.Printf("Cellar root sequences: %v\n", rootSeqs)
 
 		return nil
 	})
+	return rootSeqs
 }
 
 func parseRoot(val []byte) ([]uint64, error) {
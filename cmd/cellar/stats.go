@@ -0,0 +1,61 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/couchbaselabs/cellar"
+)
+
+// stats reads from the endpoint of a running process serving
+// Cellar.StatsHandler, the cellar itself is not opened
+func stats(args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(args[0])
+	if err != nil {
+		log.Fatalf("error fetching cellar stats: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("error fetching cellar stats: %s", resp.Status)
+	}
+	var rv cellar.StatsResponse
+	err = json.NewDecoder(resp.Body).Decode(&rv)
+	if err != nil {
+		log.Fatalf("error decoding cellar stats: %v", err)
+	}
+
+	fmt.Printf("segments: %d\n", rv.Segments)
+	fmt.Printf("merges completed: %d\n", rv.MergesCompleted)
+	fmt.Printf("merges failed: %d\n", rv.MergesFailed)
+	fmt.Printf("merge throttled: %v\n", rv.MergeThrottled)
+	fmt.Printf("active merges: %d\n", len(rv.ActiveMerges))
+	for _, merge := range rv.ActiveMerges {
+		var pct float64
+		if merge.KeysTotal > 0 {
+			pct = 100 * float64(merge.KeysProcessed) / float64(merge.KeysTotal)
+		}
+		fmt.Printf("  %016x <- %v\tkeys %d/%d (%.1f%%)\tbytes %d\telapsed %v\tdrop deletes %t\n",
+			merge.Target, merge.Sources, merge.KeysProcessed, merge.KeysTotal, pct,
+			merge.BytesProcessed, merge.Elapsed.Truncate(time.Millisecond), merge.DropDeletes)
+	}
+}
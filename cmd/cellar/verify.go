@@ -0,0 +1,43 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/couchbaselabs/cellar"
+)
+
+func verify(args []string) {
+	if len(args) != 1 {
+		usage()
+	}
+	cellarPath := args[0]
+
+	corrupt := 0
+	for _, seq := range readRoot(cellarPath) {
+		segmentPath := fmt.Sprintf("%s/cellar-%016x", cellarPath, seq)
+		err := cellar.VerifySegment(segmentPath)
+		if err != nil {
+			fmt.Printf("CORRUPT %s: %v\n", segmentPath, err)
+			corrupt++
+		} else {
+			fmt.Printf("ok      %s\n", segmentPath)
+		}
+	}
+	if corrupt > 0 {
+		fmt.Printf("%d corrupt segment(s)\n", corrupt)
+		os.Exit(1)
+	}
+}
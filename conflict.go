@@ -0,0 +1,255 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/boltdb/bolt"
+)
+
+// writable transactions run concurrently, each building its own segment
+// at commit, a transaction is checked against the keys written by every
+// commit since it began, if any of them were read or written by the
+// transaction, it fails with ErrTxConflict (first committer wins)
+//
+// the keys written by each commit are only kept while an older writable
+// transaction which might need them is still open
+
+// keyRange is an inclusive range of keys, a nil start or end is unbounded
+type keyRange struct {
+	start []byte
+	end   []byte
+}
+
+func (r *keyRange) contains(key []byte) bool {
+	return (r.start == nil || bytes.Compare(key, r.start) >= 0) &&
+		(r.end == nil || bytes.Compare(key, r.end) <= 0)
+}
+
+// readSet records the keys read by a writable transaction
+type readSet struct {
+	keys   map[string]struct{}
+	ranges []keyRange
+	// keyspaces are the keys read from each named keyspace
+	keyspaces map[string]*readSet
+}
+
+func newReadSet() *readSet {
+	return &readSet{
+		keys: make(map[string]struct{}),
+	}
+}
+
+// forKeyspace returns the read set of a keyspace, "" is this one
+func (r *readSet) forKeyspace(name string) *readSet {
+	if name == "" {
+		return r
+	}
+	rv, ok := r.keyspaces[name]
+	if !ok {
+		if r.keyspaces == nil {
+			r.keyspaces = make(map[string]*readSet)
+		}
+		rv = newReadSet()
+		r.keyspaces[name] = rv
+	}
+	return rv
+}
+
+func (r *readSet) addKey(key []byte) {
+	r.keys[string(key)] = struct{}{}
+}
+
+// addRange records that every key in [start, end] was read, typically by
+// a cursor, consecutive steps of a cursor extend the same range
+func (r *readSet) addRange(start, end []byte) {
+	if n := len(r.ranges); n > 0 {
+		last := &r.ranges[n-1]
+		if last.end != nil && start != nil && bytes.Equal(last.end, start) {
+			last.end = copyKey(end)
+			return
+		}
+		if last.start != nil && end != nil && bytes.Equal(last.start, end) {
+			last.start = copyKey(start)
+			return
+		}
+	}
+	r.ranges = append(r.ranges, keyRange{start: copyKey(start), end: copyKey(end)})
+}
+
+// conflicts returns true if any of the keys were read
+func (r *readSet) conflicts(written keyspaceKeys) bool {
+	for name, keys := range written {
+		if name == "" {
+			if r.conflictsKeyspace(keys) {
+				return true
+			}
+		} else if keyspace, ok := r.keyspaces[name]; ok && keyspace.conflictsKeyspace(keys) {
+			return true
+		}
+	}
+	return false
+}
+
+// conflictsKeyspace returns true if any of the sorted keys were read,
+// ignoring the named keyspaces
+func (r *readSet) conflictsKeyspace(keys [][]byte) bool {
+	for key := range r.keys {
+		if containsKey(keys, []byte(key)) {
+			return true
+		}
+	}
+	for i := range r.ranges {
+		rng := &r.ranges[i]
+		j := 0
+		if rng.start != nil {
+			j = sort.Search(len(keys), func(j int) bool {
+				return bytes.Compare(keys[j], rng.start) >= 0
+			})
+		}
+		if j < len(keys) && rng.contains(keys[j]) {
+			return true
+		}
+	}
+	return false
+}
+
+func copyKey(key []byte) []byte {
+	if key == nil {
+		return nil
+	}
+	return append([]byte{}, key...)
+}
+
+// containsKey returns true if key is in the sorted keys
+func containsKey(keys [][]byte, key []byte) bool {
+	i := sort.Search(len(keys), func(i int) bool {
+		return bytes.Compare(keys[i], key) >= 0
+	})
+	return i < len(keys) && bytes.Equal(keys[i], key)
+}
+
+// keyspaceKeys are sorted keys in each keyspace, "" is the default keyspace
+type keyspaceKeys map[string][][]byte
+
+// overlaps returns true if any key is in both
+func (k keyspaceKeys) overlaps(other keyspaceKeys) bool {
+	for name, keys := range k {
+		otherKeys := other[name]
+		for _, key := range keys {
+			if containsKey(otherKeys, key) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// commitRecord is the set of keys written by one commit
+type commitRecord struct {
+	seq  uint64
+	keys keyspaceKeys
+}
+
+// segmentKeys returns the sorted keys mutated or deleted in each keyspace
+// of the segment
+func segmentKeys(s *segment) (keyspaceKeys, error) {
+	rv := make(keyspaceKeys)
+	err := s.View(func(tx *bolt.Tx) error {
+		for _, name := range append([]string{""}, segmentKeyspaceNames(tx)...) {
+			var keys [][]byte
+			mutations, deletions := segmentKeyspace(tx, name)
+			for _, bucket := range []*bolt.Bucket{mutations, deletions} {
+				err := bucket.ForEach(func(k, v []byte) error {
+					keys = append(keys, copyKey(k))
+					return nil
+				})
+				if err != nil {
+					return err
+				}
+			}
+			sort.Slice(keys, func(i, j int) bool {
+				return bytes.Compare(keys[i], keys[j]) < 0
+			})
+			rv[name] = keys
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// beginWriter registers a writable transaction, returning the commit seq it
+// begins after and the root and memtable it reads from, which reflect
+// exactly those commits
+func (c *Cellar) beginWriter(tx *Tx) (uint64, segmentList, *memtable) {
+	c.commitLock.Lock()
+	defer c.commitLock.Unlock()
+	c.writers[tx] = c.commitSeq
+	root, mem := c.getView("cellar begin")
+	return c.commitSeq, root, mem
+}
+
+// endWriterLocked unregisters a writable transaction, and forgets the commits no
+// open transaction needs to check against
+// the caller must hold commitLock
+func (c *Cellar) endWriterLocked(tx *Tx) {
+	delete(c.writers, tx)
+	oldest := c.commitSeq
+	for _, begin := range c.writers {
+		if begin < oldest {
+			oldest = begin
+		}
+	}
+	i := 0
+	for i < len(c.commits) && c.commits[i].seq <= oldest {
+		i++
+	}
+	c.commits = append(c.commits[:0], c.commits[i:]...)
+}
+
+// validateLocked checks the transaction against the commits since it
+// began, writtenKeys returns the sorted keys it wrote, which are returned
+// if another open transaction will need to check against them
+// the caller must hold commitLock
+func (c *Cellar) validateLocked(tx *Tx, writtenKeys func() (keyspaceKeys, error)) (keyspaceKeys, error) {
+	// every other open writer began before this commit
+	needed := len(c.writers) > 1
+	var since []commitRecord
+	for _, commit := range c.commits {
+		if commit.seq > tx.beginSeq {
+			since = append(since, commit)
+		}
+	}
+	if len(since) == 0 && !needed {
+		return nil, nil
+	}
+
+	written, err := writtenKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, commit := range since {
+		if tx.reads.conflicts(commit.keys) || written.overlaps(commit.keys) {
+			return nil, ErrTxConflict
+		}
+	}
+	if !needed {
+		return nil, nil
+	}
+	return written, nil
+}
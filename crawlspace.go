@@ -0,0 +1,97 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"time"
+)
+
+// CrawlspaceRetention describes how long abandoned segments are kept in the
+// crawlspace.  A file is purged as soon as it falls outside any of the
+// limits, a zero value for a limit means that limit is not enforced.
+type CrawlspaceRetention struct {
+	// MaxAge is the longest time a file is kept after entering the crawlspace
+	MaxAge time.Duration
+	// MaxBytes is the total size of the files kept, newest files are kept first
+	MaxBytes int64
+	// KeepLast is the number of newest files kept
+	KeepLast int
+	// All purges every file, whatever the other limits
+	All bool
+}
+
+// CrawlspacePath returns the directory abandoned segments of the cellar at
+// cellarPath are moved to
+func CrawlspacePath(cellarPath string) string {
+	return fmt.Sprintf("%s%s%s", cellarPath, string(os.PathSeparator), crawlSpaceName)
+}
+
+// PurgeCrawlspace removes the files in the crawlspace of the cellar at path
+// which fall outside the retention policy, the names of the removed files
+// are returned.  If retention is nil, nothing is removed, to remove every
+// file set All.
+// It is safe to call this on a cellar which is open in another process.
+func PurgeCrawlspace(path string, retention *CrawlspaceRetention) ([]string, error) {
+	if retention == nil {
+		return nil, nil
+	}
+	dir := CrawlspacePath(path)
+	fileInfos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("error reading cellar crawlspace entries: %v", err)
+	}
+	// newest first
+	sort.SliceStable(fileInfos, func(i, j int) bool {
+		return fileInfos[i].ModTime().After(fileInfos[j].ModTime())
+	})
+
+	var rv []string
+	var kept int
+	var keptBytes int64
+	now := time.Now()
+	for _, fileInfo := range fileInfos {
+		if fileInfo.IsDir() {
+			continue
+		}
+		purge := retention.All ||
+			(retention.KeepLast > 0 && kept >= retention.KeepLast) ||
+			(retention.MaxAge > 0 && now.Sub(fileInfo.ModTime()) > retention.MaxAge) ||
+			(retention.MaxBytes > 0 && keptBytes+fileInfo.Size() > retention.MaxBytes)
+		if !purge {
+			kept++
+			keptBytes += fileInfo.Size()
+			continue
+		}
+		err = os.Remove(fmt.Sprintf("%s%s%s", dir, string(os.PathSeparator), fileInfo.Name()))
+		if err != nil {
+			return rv, fmt.Errorf("error removing crawlspace file %s: %v", fileInfo.Name(), err)
+		}
+		rv = append(rv, fileInfo.Name())
+	}
+	return rv, nil
+}
+
+// PurgeCrawlspace removes the files in the crawlspace which fall outside the
+// Options.CrawlspaceRetention policy, the names of the removed files are
+// returned.  If no policy is configured, nothing is removed.
+func (c *Cellar) PurgeCrawlspace() ([]string, error) {
+	rv, err := PurgeCrawlspace(c.path, c.options.CrawlspaceRetention)
+	for _, name := range rv {
+		Logger.Printf("purged %s from crawlspace", name)
+	}
+	return rv, err
+}
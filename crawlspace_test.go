@@ -0,0 +1,131 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+// makeCrawlspace creates files cellar-1 (oldest) to cellar-n (newest) in
+// the crawlspace, each 100 bytes and 1 hour apart
+func makeCrawlspace(t *testing.T, n int) {
+	err := os.MkdirAll("test/.crawlspace", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for i := 1; i <= n; i++ {
+		path := fmt.Sprintf("test/.crawlspace/cellar-%d", i)
+		err = ioutil.WriteFile(path, make([]byte, 100), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mtime := now.Add(-time.Duration(n-i) * time.Hour)
+		err = os.Chtimes(path, mtime, mtime)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestPurgeCrawlspace(t *testing.T) {
+	tests := []struct {
+		retention *CrawlspaceRetention
+		purged    []string
+	}{
+		{
+			retention: nil,
+			purged:    nil,
+		},
+		{
+			retention: &CrawlspaceRetention{},
+			purged:    nil,
+		},
+		{
+			retention: &CrawlspaceRetention{All: true},
+			purged:    []string{"cellar-1", "cellar-2", "cellar-3", "cellar-4", "cellar-5"},
+		},
+		{
+			retention: &CrawlspaceRetention{KeepLast: 2, All: true},
+			purged:    []string{"cellar-1", "cellar-2", "cellar-3", "cellar-4", "cellar-5"},
+		},
+		{
+			retention: &CrawlspaceRetention{KeepLast: 2},
+			purged:    []string{"cellar-1", "cellar-2", "cellar-3"},
+		},
+		{
+			retention: &CrawlspaceRetention{MaxAge: 90 * time.Minute},
+			purged:    []string{"cellar-1", "cellar-2", "cellar-3"},
+		},
+		{
+			retention: &CrawlspaceRetention{MaxBytes: 350},
+			purged:    []string{"cellar-1", "cellar-2"},
+		},
+		{
+			retention: &CrawlspaceRetention{KeepLast: 4, MaxBytes: 350},
+			purged:    []string{"cellar-1", "cellar-2"},
+		},
+	}
+
+	for _, test := range tests {
+		makeCrawlspace(t, 5)
+		purged, err := PurgeCrawlspace("test", test.retention)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(purged)
+		if !reflect.DeepEqual(purged, test.purged) {
+			t.Errorf("expected %v purged for %+v, got %v", test.purged, test.retention, purged)
+		}
+		os.RemoveAll("test")
+	}
+}
+
+func TestCellarCrawlspaceRetentionOnOpen(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	makeCrawlspace(t, 5)
+
+	// an abandoned segment, which will be moved to the crawlspace
+	err := ioutil.WriteFile("test/cellar-0000000000000009", make([]byte, 100), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := Open("test", &Options{
+		CrawlspaceRetention: &CrawlspaceRetention{KeepLast: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	fileInfos, err := ioutil.ReadDir("test/.crawlspace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fileInfo := range fileInfos {
+		names = append(names, fileInfo.Name())
+	}
+	expected := []string{"cellar-0000000000000009", "cellar-5"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("expected crawlspace to contain %v, got %v", expected, names)
+	}
+}
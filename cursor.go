@@ -14,29 +14,43 @@ package cellar
 
 import (
 	"bytes"
-
-	"github.com/boltdb/bolt"
 )
 
 // Cursor is a tool for iterating through k/v pairs in the cellar
+// once the cursor moves past either end, nil key and value are returned
+// until it is positioned again with First, Last or Seek
+//
+// the segments are merged with a priority queue, and the deletions cursors
+// are only ever moved forward (or backward, when iterating in reverse), so
+// the cost of each step grows logarithmically with the number of segments
 type Cursor struct {
 	reader           *reader
-	mutationsCursors []*bolt.Cursor
-	deletionsCursors []*bolt.Cursor
+	mutationsCursors []kvCursor
+	deletionsCursors []kvCursor
 
 	key  [][]byte
 	val  [][]byte
-	curr int
+	dkey [][]byte
+
+	mutations *keyHeap
+	deletions *keyHeap
+	reverse   bool
+
+	// reads, if set, records the ranges of keys the cursor moves over
+	reads *readSet
 }
 
 func newCursor(reader *reader) *Cursor {
 	rv := &Cursor{
 		reader:           reader,
-		mutationsCursors: make([]*bolt.Cursor, 0, len(reader.root)),
-		deletionsCursors: make([]*bolt.Cursor, 0, len(reader.root)),
-		key:              make([][]byte, len(reader.root)),
-		val:              make([][]byte, len(reader.root)),
+		mutationsCursors: make([]kvCursor, 0, len(reader.mutations)),
+		deletionsCursors: make([]kvCursor, 0, len(reader.mutations)),
+		key:              make([][]byte, len(reader.mutations)),
+		val:              make([][]byte, len(reader.mutations)),
+		dkey:             make([][]byte, len(reader.mutations)),
 	}
+	rv.mutations = newKeyHeap(rv.key)
+	rv.deletions = newKeyHeap(rv.dkey)
 
 	for _, mutationsBucket := range reader.mutations {
 		mutationsCursor := mutationsBucket.Cursor()
@@ -51,63 +65,170 @@ func newCursor(reader *reader) *Cursor {
 	return rv
 }
 
+// First moves the cursor to the first key
+func (c *Cursor) First() (key []byte, value []byte) {
+	for i, cursor := range c.mutationsCursors {
+		c.key[i], c.val[i] = cursor.First()
+	}
+	for i, cursor := range c.deletionsCursors {
+		c.dkey[i], _ = cursor.First()
+	}
+	c.reset(false)
+	key, value = c.current()
+	c.observe(nil, key)
+	return key, value
+}
+
+// Last moves the cursor to the last key
+func (c *Cursor) Last() (key []byte, value []byte) {
+	for i, cursor := range c.mutationsCursors {
+		c.key[i], c.val[i] = cursor.Last()
+	}
+	for i, cursor := range c.deletionsCursors {
+		c.dkey[i], _ = cursor.Last()
+	}
+	c.reset(true)
+	key, value = c.current()
+	c.observe(key, nil)
+	return key, value
+}
+
 // Seek moves the cursor to the specified key
 func (c *Cursor) Seek(seek []byte) (key []byte, value []byte) {
+	c.seek(seek)
+	key, value = c.current()
+	c.observe(seek, key)
+	return key, value
+}
+
+// Next moves the cursor to the next key
+func (c *Cursor) Next() (key []byte, value []byte) {
+	currKey, _ := c.current()
+	if currKey == nil {
+		// not positioned, or already past an end
+		return nil, nil
+	}
+	if c.reverse {
+		c.seek(currKey)
+	}
+	c.advance()
+	c.skipDeleted()
+	key, value = c.current()
+	c.observe(currKey, key)
+	return key, value
+}
+
+// Prev moves the cursor to the previous key
+func (c *Cursor) Prev() (key []byte, value []byte) {
+	currKey, _ := c.current()
+	if currKey == nil {
+		// not positioned, or already past an end
+		return nil, nil
+	}
+	if !c.reverse {
+		c.seekReverse(currKey)
+	}
+	c.advance()
+	c.skipDeleted()
+	key, value = c.current()
+	c.observe(key, currKey)
+	return key, value
+}
+
+// observe records that the cursor has read every key in [start, end],
+// a nil start or end is unbounded
+func (c *Cursor) observe(start, end []byte) {
+	if c.reads != nil {
+		c.reads.addRange(start, end)
+	}
+}
+
+// seek positions every cursor at the first key >= seek
+// segments entirely before seek are not consulted at all
+func (c *Cursor) seek(seek []byte) {
 	for i, cursor := range c.mutationsCursors {
+		if c.reader.segments[i].afterRange(seek) {
+			c.key[i], c.val[i] = nil, nil
+			c.dkey[i] = nil
+			continue
+		}
 		c.key[i], c.val[i] = cursor.Seek(seek)
+		c.dkey[i], _ = c.deletionsCursors[i].Seek(seek)
 	}
-	c.updateCurr()
-	for c.checkCurrDeleted() {
-		c.next()
-		c.updateCurr()
-	}
-	return c.key[c.curr], c.val[c.curr]
+	c.reset(false)
 }
 
-func (c *Cursor) next() {
-	currKey := c.key[c.curr]
-	// increment any cursor pointing at the
-	// current key (could be more than just 1)
+// seekReverse positions every cursor at the last key <= seek
+// segments entirely after seek are not consulted at all
+func (c *Cursor) seekReverse(seek []byte) {
 	for i, cursor := range c.mutationsCursors {
-		if bytes.Compare(currKey, c.key[i]) == 0 {
-			c.key[i], c.val[i] = cursor.Next()
+		if c.reader.segments[i].beforeRange(seek) {
+			c.key[i], c.val[i] = nil, nil
+			c.dkey[i] = nil
+			continue
 		}
+		c.key[i], c.val[i] = seekReverse(cursor, seek)
+		c.dkey[i], _ = seekReverse(c.deletionsCursors[i], seek)
 	}
+	c.reset(true)
 }
 
-// Next moves the cursor to the next key
-func (c *Cursor) Next() (key []byte, value []byte) {
-	c.next()
-	c.updateCurr()
-	for c.checkCurrDeleted() {
-		c.next()
-		c.updateCurr()
+func (c *Cursor) reset(reverse bool) {
+	c.reverse = reverse
+	c.mutations.reset(reverse)
+	c.deletions.reset(reverse)
+	c.skipDeleted()
+}
+
+// current returns the k/v pair the cursor is positioned at
+func (c *Cursor) current() (key []byte, value []byte) {
+	i := c.mutations.top()
+	if i < 0 {
+		return nil, nil
 	}
-	// FIXME end case where nothing else?
-	return c.key[c.curr], c.val[c.curr]
+	return c.key[i], c.val[i]
 }
 
-func (c *Cursor) updateCurr() {
-	// find curr (iterator index with lowest key, always prefering first seen)
-	var currKey []byte
-	c.curr = 0
-	for i, k := range c.key {
-		if k != nil && (currKey == nil || bytes.Compare(k, currKey) < 0) {
-			currKey = k
-			c.curr = i
+// advance moves every mutations cursor pointing at the
+// current key (could be more than just 1) in the current direction
+func (c *Cursor) advance() {
+	currKey, _ := c.current()
+	for i := c.mutations.top(); i >= 0 && bytes.Equal(c.key[i], currKey); i = c.mutations.top() {
+		if c.reverse {
+			c.key[i], c.val[i] = c.mutationsCursors[i].Prev()
+		} else {
+			c.key[i], c.val[i] = c.mutationsCursors[i].Next()
 		}
+		c.mutations.fixTop()
+	}
+}
+
+func (c *Cursor) skipDeleted() {
+	for c.checkCurrDeleted() {
+		c.advance()
 	}
 }
 
 func (c *Cursor) checkCurrDeleted() bool {
-	currKey := c.key[c.curr]
-	// seek all the deletion cusors on previous segments to the current key
-	for _, deletionCursor := range c.deletionsCursors[:c.curr] {
-		k, _ := deletionCursor.Seek(currKey)
-		if bytes.Compare(k, currKey) == 0 {
-			// one of the segments with higher priority has this key deleted
-			return true
+	curr := c.mutations.top()
+	if curr < 0 {
+		return false
+	}
+	currKey := c.key[curr]
+	// catch up any deletions cursor which is behind the current key
+	for i := c.deletions.top(); i >= 0; i = c.deletions.top() {
+		cmp := bytes.Compare(c.dkey[i], currKey)
+		if c.reverse && cmp > 0 {
+			c.dkey[i], _ = seekReverse(c.deletionsCursors[i], currKey)
+		} else if !c.reverse && cmp < 0 {
+			c.dkey[i], _ = c.deletionsCursors[i].Seek(currKey)
+		} else {
+			break
 		}
+		c.deletions.fixTop()
 	}
-	return false
+	// the top deletion is now the highest priority segment
+	// with this key deleted (if any)
+	i := c.deletions.top()
+	return i >= 0 && i < curr && bytes.Equal(c.dkey[i], currKey)
 }
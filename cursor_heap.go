@@ -0,0 +1,101 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"bytes"
+	"container/heap"
+)
+
+// keyHeap is a priority queue of indexes into a shared slice of keys
+// the top of the heap is the lowest key (highest when reverse is set)
+// ties are broken by the lowest index, which callers use to express priority
+// only indexes with a non-nil key should be in the heap
+type keyHeap struct {
+	indexes []int
+	key     [][]byte
+	reverse bool
+}
+
+func newKeyHeap(key [][]byte) *keyHeap {
+	return &keyHeap{
+		indexes: make([]int, 0, len(key)),
+		key:     key,
+	}
+}
+
+// reset rebuilds the heap from every index currently positioned on a key
+func (h *keyHeap) reset(reverse bool) {
+	h.reverse = reverse
+	h.indexes = h.indexes[:0]
+	for i, k := range h.key {
+		if k != nil {
+			h.indexes = append(h.indexes, i)
+		}
+	}
+	heap.Init(h)
+}
+
+// top returns the index at the top of the heap, or -1 if it is empty
+func (h *keyHeap) top() int {
+	if len(h.indexes) == 0 {
+		return -1
+	}
+	return h.indexes[0]
+}
+
+// fixTop restores the heap after the key at the top has moved
+// if the key is now nil, the index is removed from the heap
+func (h *keyHeap) fixTop() {
+	if h.key[h.indexes[0]] == nil {
+		heap.Pop(h)
+	} else {
+		heap.Fix(h, 0)
+	}
+}
+
+func (h *keyHeap) Len() int { return len(h.indexes) }
+
+func (h *keyHeap) Less(i, j int) bool {
+	a, b := h.indexes[i], h.indexes[j]
+	c := bytes.Compare(h.key[a], h.key[b])
+	if c == 0 {
+		return a < b
+	}
+	if h.reverse {
+		return c > 0
+	}
+	return c < 0
+}
+
+func (h *keyHeap) Swap(i, j int) { h.indexes[i], h.indexes[j] = h.indexes[j], h.indexes[i] }
+
+func (h *keyHeap) Push(x interface{}) { h.indexes = append(h.indexes, x.(int)) }
+
+func (h *keyHeap) Pop() interface{} {
+	n := len(h.indexes)
+	rv := h.indexes[n-1]
+	h.indexes = h.indexes[:n-1]
+	return rv
+}
+
+// seekReverse positions a cursor at the last key <= seek
+func seekReverse(cursor kvCursor, seek []byte) (key []byte, value []byte) {
+	k, v := cursor.Seek(seek)
+	if k == nil {
+		return cursor.Last()
+	} else if bytes.Compare(k, seek) > 0 {
+		return cursor.Prev()
+	}
+	return k, v
+}
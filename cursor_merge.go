@@ -14,102 +14,94 @@ package cellar
 
 import (
 	"bytes"
-
-	"github.com/boltdb/bolt"
 )
 
+// mergeCursor iterates the union of all mutations and deletions
+// for each key, only the entry from the highest priority segment is returned
+// and within a segment a deletion takes priority over a mutation
+//
+// the mutations and deletions cursors share a single priority queue, with
+// the deletions cursor for segment i at index 2*i and the mutations cursor at
+// index 2*i+1, so that ties on the key resolve in priority order
 type mergeCursor struct {
-	reader           *reader
-	mutationsCursors []*bolt.Cursor
-	deletionsCursors []*bolt.Cursor
+	reader  *reader
+	cursors []kvCursor
+
+	key  [][]byte
+	val  [][]byte
+	heap *keyHeap
 
-	key       [][]byte
-	val       [][]byte
-	curr      int
-	dkey      [][]byte
-	currIsDel bool
+	// end is the exclusive upper bound of iteration, nil for none
+	end []byte
+
+	// read counts the bytes of every key and value moved past by Next,
+	// and readKeys the number of them
+	read     int
+	readKeys int
 }
 
 func newMergeCursor(reader *reader) *mergeCursor {
 	rv := &mergeCursor{
-		reader:           reader,
-		mutationsCursors: make([]*bolt.Cursor, 0, len(reader.root)),
-		deletionsCursors: make([]*bolt.Cursor, 0, len(reader.root)),
-		key:              make([][]byte, len(reader.root)),
-		val:              make([][]byte, len(reader.root)),
-		dkey:             make([][]byte, len(reader.root)),
+		reader:  reader,
+		cursors: make([]kvCursor, 0, 2*len(reader.mutations)),
+		key:     make([][]byte, 2*len(reader.mutations)),
+		val:     make([][]byte, 2*len(reader.mutations)),
 	}
+	rv.heap = newKeyHeap(rv.key)
 
-	for _, mutationsBucket := range reader.mutations {
+	for i, mutationsBucket := range reader.mutations {
+		deletionsCursor := reader.deletions[i].Cursor()
 		mutationsCursor := mutationsBucket.Cursor()
-		rv.mutationsCursors = append(rv.mutationsCursors, mutationsCursor)
-	}
-
-	for _, deletionsBucket := range reader.deletions {
-		deletionsCursor := deletionsBucket.Cursor()
-		rv.deletionsCursors = append(rv.deletionsCursors, deletionsCursor)
+		rv.cursors = append(rv.cursors, deletionsCursor, mutationsCursor)
 	}
 
 	return rv
 }
 
 func (c *mergeCursor) Seek(seek []byte) (key []byte, value []byte, deleted bool) {
-	for i, cursor := range c.mutationsCursors {
+	return c.SeekRange(seek, nil)
+}
+
+// SeekRange is like Seek, but iteration stops before the first key >= end
+// a nil end is unbounded
+func (c *mergeCursor) SeekRange(seek, end []byte) (key []byte, value []byte, deleted bool) {
+	c.end = end
+	for i, cursor := range c.cursors {
+		if !c.reader.segments[i/2].overlaps(seek, end) {
+			// segment entirely outside [seek, end)
+			c.key[i], c.val[i] = nil, nil
+			continue
+		}
 		c.key[i], c.val[i] = cursor.Seek(seek)
 	}
-	for i, cursor := range c.deletionsCursors {
-		c.dkey[i], _ = cursor.Seek(seek)
+	c.heap.reset(false)
+	return c.current()
+}
+
+func (c *mergeCursor) current() (key []byte, value []byte, deleted bool) {
+	i := c.heap.top()
+	if i < 0 || (c.end != nil && bytes.Compare(c.key[i], c.end) >= 0) {
+		return nil, nil, false
 	}
-	c.updateCurr()
-	if c.currIsDel {
-		return c.dkey[c.curr], nil, true
+	if i%2 == 0 {
+		return c.key[i], nil, true
 	}
-	return c.key[c.curr], c.val[c.curr], false
+	return c.key[i], c.val[i], false
 }
 
 func (c *mergeCursor) next() {
-	currKey := c.key[c.curr]
-	if c.currIsDel {
-		currKey = c.dkey[c.curr]
-	}
+	currKey, _, _ := c.current()
 	// increment any cursor pointing at the
 	// current key (could be more than just 1)
-	for i, cursor := range c.mutationsCursors {
-		if bytes.Compare(currKey, c.key[i]) == 0 {
-			c.key[i], c.val[i] = cursor.Next()
-		}
-	}
-	for i, cursor := range c.deletionsCursors {
-		if bytes.Compare(currKey, c.dkey[i]) == 0 {
-			c.dkey[i], _ = cursor.Next()
-		}
+	for i := c.heap.top(); i >= 0 && bytes.Equal(c.key[i], currKey); i = c.heap.top() {
+		c.read += len(c.key[i]) + len(c.val[i])
+		c.readKeys++
+		c.key[i], c.val[i] = c.cursors[i].Next()
+		c.heap.fixTop()
 	}
 }
 
 func (c *mergeCursor) Next() (key []byte, value []byte, deleted bool) {
 	c.next()
-	c.updateCurr()
-	if c.currIsDel {
-		return c.dkey[c.curr], nil, true
-	}
-	return c.key[c.curr], c.val[c.curr], false
-}
-
-func (c *mergeCursor) updateCurr() {
-	// find curr (iterator index with lowest key, always prefering first seen)
-	var currKey []byte
-	c.curr = 0
-	for i, k := range c.key {
-		dk := c.dkey[i]
-		if dk != nil && (currKey == nil || bytes.Compare(dk, currKey) < 0) {
-			currKey = dk
-			c.curr = i
-			c.currIsDel = true
-		}
-		if k != nil && (currKey == nil || bytes.Compare(k, currKey) < 0) {
-			currKey = k
-			c.curr = i
-			c.currIsDel = false
-		}
-	}
+	return c.current()
 }
@@ -13,7 +13,9 @@
 package cellar
 
 import (
+	"fmt"
 	"os"
+	"reflect"
 	"testing"
 )
 
@@ -69,3 +71,289 @@ func TestCellarCursorSimple(t *testing.T) {
 	}
 
 }
+
+func TestCellarCursorBidirectional(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// cursor on an empty cellar
+	err = c.View(func(tx *Tx) error {
+		c := tx.Cursor()
+		if k, _ := c.First(); k != nil {
+			t.Errorf("first on empty cellar expects nil, got key %s", string(k))
+		}
+		if k, _ := c.Last(); k != nil {
+			t.Errorf("last on empty cellar expects nil, got key %s", string(k))
+		}
+		if k, _ := c.Prev(); k != nil {
+			t.Errorf("prev on empty cellar expects nil, got key %s", string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// spread the data over 3 segments
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 0, 10)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 5, 15)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// delete the first, last and a few middle keys
+	err = c.Update(func(tx *Tx) error {
+		for _, k := range []string{"k0000000000000000", "k0000000000000006", "k0000000000000007", "k000000000000000e"} {
+			err := tx.Delete([]byte(k))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"k0000000000000001",
+		"k0000000000000002",
+		"k0000000000000003",
+		"k0000000000000004",
+		"k0000000000000005",
+		"k0000000000000008",
+		"k0000000000000009",
+		"k000000000000000a",
+		"k000000000000000b",
+		"k000000000000000c",
+		"k000000000000000d",
+	}
+
+	err = c.View(func(tx *Tx) error {
+		c := tx.Cursor()
+
+		k, _ := c.Prev()
+		if k != nil {
+			t.Errorf("prev on cursor before positioning expects nil, got key %s", string(k))
+		}
+
+		// full forward scan
+		var actual []string
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			actual = append(actual, string(k))
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected forward %v, got %v", expected, actual)
+		}
+		// past the end stays there
+		if k, _ := c.Prev(); k != nil {
+			t.Errorf("prev after end expects nil, got key %s", string(k))
+		}
+
+		// full reverse scan
+		actual = nil
+		for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+			actual = append(actual, string(k))
+		}
+		for i := 0; i < len(actual)/2; i++ {
+			actual[i], actual[len(actual)-1-i] = actual[len(actual)-1-i], actual[i]
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("expected reverse %v, got %v", expected, actual)
+		}
+		if k, _ := c.Next(); k != nil {
+			t.Errorf("next after beginning expects nil, got key %s", string(k))
+		}
+
+		// change direction in the middle, across deleted keys
+		k, v := c.Seek([]byte("k0000000000000006"))
+		if string(k) != "k0000000000000008" || string(v) != "v0000000000000008" {
+			t.Errorf("expected to see key 'k0000000000000008' got %s/%s", string(k), string(v))
+		}
+		k, _ = c.Prev()
+		if string(k) != "k0000000000000005" {
+			t.Errorf("expected to see key 'k0000000000000005' got %s", string(k))
+		}
+		k, _ = c.Next()
+		if string(k) != "k0000000000000008" {
+			t.Errorf("expected to see key 'k0000000000000008' got %s", string(k))
+		}
+		k, _ = c.Next()
+		if string(k) != "k0000000000000009" {
+			t.Errorf("expected to see key 'k0000000000000009' got %s", string(k))
+		}
+		k, _ = c.Prev()
+		if string(k) != "k0000000000000008" {
+			t.Errorf("expected to see key 'k0000000000000008' got %s", string(k))
+		}
+
+		// seek past the end, then walk backward from last
+		k, _ = c.Seek([]byte("k1"))
+		if k != nil {
+			t.Errorf("seek past end expects nil, got key %s", string(k))
+		}
+		k, _ = c.Last()
+		if string(k) != "k000000000000000d" {
+			t.Errorf("expected to see key 'k000000000000000d' got %s", string(k))
+		}
+		k, _ = c.Prev()
+		if string(k) != "k000000000000000c" {
+			t.Errorf("expected to see key 'k000000000000000c' got %s", string(k))
+		}
+
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// buildBenchCellar creates a cellar with the requested number of segments
+// the keys of each segment are interleaved with the keys of all the others,
+// and every segment deletes a few keys written by older segments
+func buildBenchCellar(b *testing.B, segments, keysPerSegment int) *Cellar {
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for s := 0; s < segments; s++ {
+		err = c.Update(func(tx *Tx) error {
+			for i := 0; i < keysPerSegment; i++ {
+				k := i*segments + s
+				err := tx.Put([]byte(fmt.Sprintf("k%016x", k)), []byte(fmt.Sprintf("v%016x", k)))
+				if err != nil {
+					return err
+				}
+				if s > 0 && i%10 == 0 {
+					err = tx.Delete([]byte(fmt.Sprintf("k%016x", k-1)))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	return c
+}
+
+func benchmarkCursorScan(b *testing.B, segments int, reverse bool) {
+	defer os.RemoveAll("test")
+
+	c := buildBenchCellar(b, segments, 10000/segments)
+	defer c.Close()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c.View(func(tx *Tx) error {
+			c := tx.Cursor()
+			if reverse {
+				for k, _ := c.Last(); k != nil; k, _ = c.Prev() {
+				}
+			} else {
+				for k, _ := c.First(); k != nil; k, _ = c.Next() {
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCursorScan1Segment(b *testing.B)          { benchmarkCursorScan(b, 1, false) }
+func BenchmarkCursorScan4Segments(b *testing.B)         { benchmarkCursorScan(b, 4, false) }
+func BenchmarkCursorScan16Segments(b *testing.B)        { benchmarkCursorScan(b, 16, false) }
+func BenchmarkCursorScan64Segments(b *testing.B)        { benchmarkCursorScan(b, 64, false) }
+func BenchmarkCursorScanReverse64Segments(b *testing.B) { benchmarkCursorScan(b, 64, true) }
+
+func TestCellarCursorSegmentRanges(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// 3 segments with disjoint key ranges, the newest also deleting
+	// the last key of the middle one
+	for i := 0; i < 3; i++ {
+		err = c.Update(func(tx *Tx) error {
+			err := putKvPairs(tx, i*100, (i+1)*100)
+			if err != nil {
+				return err
+			}
+			if i == 2 {
+				return tx.Delete([]byte("k00000000000000c7"))
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	root := c.getRoot("TestCellarCursorSegmentRanges")
+	expectedRanges := [][]string{
+		{"k00000000000000c7", "k000000000000012b"},
+		{"k0000000000000064", "k00000000000000c7"},
+		{"k0000000000000000", "k0000000000000063"},
+	}
+	for i, segment := range root {
+		if string(segment.minKey) != expectedRanges[i][0] || string(segment.maxKey) != expectedRanges[i][1] {
+			t.Errorf("expected segment %d range %v, got [%s %s]", segment.seq, expectedRanges[i], segment.minKey, segment.maxKey)
+		}
+		segment.decrRef("test done with refs")
+	}
+
+	err = c.View(func(tx *Tx) error {
+		checkKey(t, tx, "k0000000000000000", "v0000000000000000")
+		checkKey(t, tx, "k0000000000000064", "v0000000000000064")
+		checkNoKey(t, tx, "k00000000000000c7")
+		checkKey(t, tx, "k000000000000012b", "v000000000000012b")
+		checkNoKey(t, tx, "k1")
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k000000000000012b", "v000000000000012b", 299)
+
+		c := tx.Cursor()
+		k, _ := c.Seek([]byte("k00000000000000c6"))
+		if string(k) != "k00000000000000c6" {
+			t.Errorf("expected to see key 'k00000000000000c6' got %s", string(k))
+		}
+		k, _ = c.Next()
+		if string(k) != "k00000000000000c8" {
+			t.Errorf("expected to see key 'k00000000000000c8' got %s", string(k))
+		}
+		k, _ = c.Prev()
+		if string(k) != "k00000000000000c6" {
+			t.Errorf("expected to see key 'k00000000000000c6' got %s", string(k))
+		}
+		k, _ = c.Seek([]byte("k0000000000000064"))
+		if string(k) != "k0000000000000064" {
+			t.Errorf("expected to see key 'k0000000000000064' got %s", string(k))
+		}
+		k, _ = c.Prev()
+		if string(k) != "k0000000000000063" {
+			t.Errorf("expected to see key 'k0000000000000063' got %s", string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,7 +12,10 @@
 
 package cellar
 
-import "errors"
+import (
+	"errors"
+	"fmt"
+)
 
 var (
 	// ErrTxClosed is returned whe operating on a closed cellar/bolt
@@ -23,4 +26,27 @@ var (
 	// ErrTxIsManaged is returned when commit/rollback has been performed
 	// on a managed transaction (Update/View)
 	ErrTxIsManaged = errors.New("managed tx rollback/commit not allowed")
+	// ErrTxConflict is returned by Commit when another transaction has
+	// committed a change to a key this transaction read or wrote, since
+	// this transaction began
+	ErrTxConflict = errors.New("tx conflict")
+	// ErrMergeCanceled is returned when a merge is aborted by CancelMerges
+	ErrMergeCanceled = errors.New("merge canceled")
+	// ErrInvalidRange is returned by CompactRange when start does not sort
+	// before end
+	ErrInvalidRange = errors.New("invalid range, start must sort before end")
 )
+
+// MergeError describes a failed background merge, it is passed to
+// Options.MergeErrorCallback
+type MergeError struct {
+	// Sources are the seqs of the segments being merged
+	Sources []uint64
+	// Attempt is the number of times this merge has failed
+	Attempt int
+	Err     error
+}
+
+func (e *MergeError) Error() string {
+	return fmt.Sprintf("merge of %v failed (attempt %d): %v", e.Sources, e.Attempt, e.Err)
+}
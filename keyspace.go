@@ -0,0 +1,110 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+// Keyspace is a named set of keys within the cellar, separate from the keys
+// of the cellar itself and of every other keyspace.  Each segment holds the
+// mutations and deletions of each keyspace in buckets of their own, while
+// the root, merges and transactions are shared, so writes to any keyspaces
+// in one transaction commit atomically.
+// A Keyspace is only valid for the life of the transaction it came from.
+type Keyspace struct {
+	tx     *Tx
+	name   string
+	reader *reader
+	reads  *readSet
+}
+
+// Keyspace returns the named keyspace, which is empty until keys are put in
+// it.  The empty name is the keys of the cellar itself, as read and written
+// by the transaction directly.
+func (tx *Tx) Keyspace(name string) *Keyspace {
+	if rv, ok := tx.keyspaces[name]; ok {
+		return rv
+	}
+	rv := &Keyspace{
+		tx:   tx,
+		name: name,
+	}
+	if tx.reader != nil {
+		rv.reader = tx.reader
+		if name != "" {
+			rv.reader = tx.reader.forKeyspace(name)
+		}
+	}
+	if tx.reads != nil {
+		rv.reads = tx.reads.forKeyspace(name)
+	}
+	if tx.keyspaces == nil {
+		tx.keyspaces = make(map[string]*Keyspace)
+	}
+	tx.keyspaces[name] = rv
+	return rv
+}
+
+// Name returns the name of the keyspace
+func (k *Keyspace) Name() string {
+	return k.name
+}
+
+// Get will look up the specified key in the keyspace
+// if there is no value, nil is returned
+// in a writable transaction, uncommitted Put/Delete operations are visible
+func (k *Keyspace) Get(key []byte) []byte {
+	if k.reads != nil {
+		k.reads.addKey(key)
+	}
+	return k.reader.Get(key)
+}
+
+// Cursor returns an object which can be used to iterate k/v pairs in the
+// keyspace
+func (k *Keyspace) Cursor() *Cursor {
+	rv := newCursor(k.reader)
+	rv.reads = k.reads
+	return rv
+}
+
+// Put will update the value for the specified key in the keyspace
+func (k *Keyspace) Put(key []byte, value []byte) error {
+	tx := k.tx
+	if tx.cellar == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	if k.name == "" {
+		return tx.Put(key, value)
+	}
+	if tx.buffer != nil {
+		return tx.buffer.forKeyspace(k.name).Put(key, value)
+	}
+	return tx.segmentBuilder.PutKeyspace(k.name, key, value)
+}
+
+// Delete will remove the key from the keyspace
+func (k *Keyspace) Delete(key []byte) error {
+	tx := k.tx
+	if tx.cellar == nil {
+		return ErrTxClosed
+	} else if !tx.writable {
+		return ErrTxNotWritable
+	}
+	if k.name == "" {
+		return tx.Delete(key)
+	}
+	if tx.buffer != nil {
+		return tx.buffer.forKeyspace(k.name).Delete(key)
+	}
+	return tx.segmentBuilder.DeleteKeyspace(k.name, key)
+}
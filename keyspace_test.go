@@ -0,0 +1,265 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// putKeyspaceKvPairs puts keys start to end in the keyspace, with the
+// keyspace name in the value
+func putKeyspaceKvPairs(k *Keyspace, start, end int) error {
+	for i := start; i < end; i++ {
+		err := k.Put([]byte(fmt.Sprintf("k%016x", i)), []byte(fmt.Sprintf("%s%016x", k.Name(), i)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func checkKeyspaceCursor(t *testing.T, k *Keyspace, first, last, count int) {
+	c := k.Cursor()
+	n := 0
+	for key, val := c.First(); key != nil; key, val = c.Next() {
+		if n == 0 && string(key) != fmt.Sprintf("k%016x", first) {
+			t.Errorf("keyspace %q: expected first key k%016x, got %s", k.Name(), first, key)
+		}
+		if expected := fmt.Sprintf("%s%016x", k.Name(), last); string(key) == fmt.Sprintf("k%016x", last) && string(val) != expected {
+			t.Errorf("keyspace %q: expected last value %s, got %s", k.Name(), expected, val)
+		}
+		n++
+	}
+	if n != count {
+		t.Errorf("keyspace %q: expected %d keys, got %d", k.Name(), count, n)
+	}
+	key, _ := c.Last()
+	if count > 0 && string(key) != fmt.Sprintf("k%016x", last) {
+		t.Errorf("keyspace %q: expected last key k%016x, got %s", k.Name(), last, key)
+	}
+}
+
+func TestKeyspace(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *Options
+	}{
+		{"segments", &Options{BloomFalsePositiveRate: 0.01}},
+		{"memtable", &Options{BloomFalsePositiveRate: 0.01, MemtableSize: 1 << 30, MemtableFlushInterval: time.Hour}},
+	}
+	for _, test := range tests {
+		func() {
+			defer os.RemoveAll("test")
+
+			c, err := Open("test", test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// the same keys in the cellar and two keyspaces, in one commit
+			err = c.Update(func(tx *Tx) error {
+				err := putKvPairs(tx, 0, 10)
+				if err != nil {
+					return err
+				}
+				err = putKeyspaceKvPairs(tx.Keyspace("a"), 5, 15)
+				if err != nil {
+					return err
+				}
+				// uncommitted writes to a keyspace are visible to it only
+				checkKeyspaceCursor(t, tx.Keyspace("a"), 5, 14, 10)
+				return putKeyspaceKvPairs(tx.Keyspace("b"), 0, 3)
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			// a later commit deletes from one keyspace only
+			err = c.Update(func(tx *Tx) error {
+				for i := 5; i < 10; i++ {
+					err := tx.Keyspace("a").Delete([]byte(fmt.Sprintf("k%016x", i)))
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+
+			check := func(when string) {
+				err := c.View(func(tx *Tx) error {
+					checkKey(t, tx, fmt.Sprintf("k%016x", 5), fmt.Sprintf("v%016x", 5))
+					checkCursor(t, tx, fmt.Sprintf("k%016x", 0), fmt.Sprintf("v%016x", 0),
+						fmt.Sprintf("k%016x", 9), fmt.Sprintf("v%016x", 9), 10)
+					a := tx.Keyspace("a")
+					if v := a.Get([]byte(fmt.Sprintf("k%016x", 5))); v != nil {
+						t.Errorf("%s %s: expected deleted key in keyspace a, got %s", test.name, when, v)
+					}
+					if v := a.Get([]byte(fmt.Sprintf("k%016x", 12))); string(v) != fmt.Sprintf("a%016x", 12) {
+						t.Errorf("%s %s: expected a%016x, got %s", test.name, when, 12, v)
+					}
+					checkKeyspaceCursor(t, a, 10, 14, 5)
+					checkKeyspaceCursor(t, tx.Keyspace("b"), 0, 2, 3)
+					checkKeyspaceCursor(t, tx.Keyspace("none"), 0, 0, 0)
+					if tx.Keyspace("") != tx.Keyspace("") || tx.Keyspace("").Get([]byte(fmt.Sprintf("k%016x", 0))) == nil {
+						t.Errorf("%s %s: expected empty keyspace name to be the cellar itself", test.name, when)
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatalf("%s %s: %v", test.name, when, err)
+				}
+			}
+			check("before reopen")
+
+			if test.options.MemtableSize > 0 {
+				crash(t, c)
+			} else {
+				err = c.Close()
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			c, err = Open("test", test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			check("after reopen")
+
+			err = c.CompactRange(context.Background(), []byte(fmt.Sprintf("k%016x", 2)), []byte(fmt.Sprintf("k%016x", 4)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("after compact range")
+			err = c.Compact(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("after compact")
+			root := c.getRoot("test")
+			for _, segment := range root {
+				segment.decrRef("test done with refs")
+			}
+			if len(root) != 1 || root[0].deletions != 0 || root[0].mutations != 18 {
+				t.Errorf("%s: expected 1 segment with 18 mutations, 0 deletions", test.name)
+			}
+			err = c.Verify(context.Background())
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+		}()
+	}
+}
+
+func TestKeyspaceRollback(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Update(func(tx *Tx) error {
+		err := putKeyspaceKvPairs(tx.Keyspace("a"), 0, 5)
+		if err != nil {
+			return err
+		}
+		err = putKeyspaceKvPairs(tx.Keyspace("b"), 0, 5)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("changed my mind")
+	})
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	err = c.View(func(tx *Tx) error {
+		checkKeyspaceCursor(t, tx.Keyspace("a"), 0, 0, 0)
+		checkKeyspaceCursor(t, tx.Keyspace("b"), 0, 0, 0)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx, err := c.Begin(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Keyspace("a").Put([]byte("k"), []byte("v"))
+	if err != ErrTxNotWritable {
+		t.Errorf("expected ErrTxNotWritable, got %v", err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Keyspace("a").Delete([]byte("k"))
+	if err != ErrTxClosed {
+		t.Errorf("expected ErrTxClosed, got %v", err)
+	}
+}
+
+func TestKeyspaceConflict(t *testing.T) {
+	tests := []struct {
+		name         string
+		readKeyspace string
+		conflict     bool
+	}{
+		{"same keyspace", "a", true},
+		{"other keyspace", "b", false},
+		{"cellar", "", false},
+	}
+	for _, test := range tests {
+		func() {
+			defer os.RemoveAll("test")
+
+			c, err := Open("test", testOptionsNoAutoMerge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			tx1, err := c.Begin(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx1.Keyspace(test.readKeyspace).Get([]byte("k"))
+			err = tx1.Put([]byte("other"), []byte("1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = c.Update(func(tx *Tx) error {
+				return tx.Keyspace("a").Put([]byte("k"), []byte("2"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = tx1.Commit()
+			if test.conflict && err != ErrTxConflict {
+				t.Errorf("%s: expected ErrTxConflict, got %v", test.name, err)
+			} else if !test.conflict && err != nil {
+				t.Errorf("%s: expected no conflict, got %v", test.name, err)
+			}
+		}()
+	}
+}
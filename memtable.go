@@ -0,0 +1,570 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"bytes"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/boltdb/bolt"
+)
+
+// when Options.MemtableSize is set, writable transactions buffer their
+// writes in memory instead of building a segment, and commit them as an
+// immutable sorted run on the memtable.  Readers consult the runs, newest
+// first, before the segments.  Once the runs reach MemtableSize bytes, or
+// MemtableFlushInterval has passed, they are flushed to a single new segment.
+//
+// to keep the number of runs a reader consults small, a newly committed run
+// is merged with the next newest while it is at least half its size
+//
+// commits in the memtable are also appended to a write-ahead log, which is
+// replayed by Open if the process exits before they are flushed, see wal.go
+
+const defaultMemtableFlushInterval = time.Second
+
+// memKV is a key and its value, the value of a deletion is empty
+type memKV struct {
+	key []byte
+	val []byte
+}
+
+// memBucket is an immutable in-memory bucket, sorted by key
+type memBucket []memKV
+
+func (b memBucket) search(key []byte) int {
+	return sort.Search(len(b), func(i int) bool {
+		return bytes.Compare(b[i].key, key) >= 0
+	})
+}
+
+func (b memBucket) Get(key []byte) []byte {
+	i := b.search(key)
+	if i < len(b) && bytes.Equal(b[i].key, key) {
+		return b[i].val
+	}
+	return nil
+}
+
+func (b memBucket) Cursor() kvCursor {
+	return &memCursor{bucket: b, i: -1}
+}
+
+// memCursor iterates a memBucket, like a bolt cursor
+type memCursor struct {
+	bucket memBucket
+	i      int
+}
+
+func (c *memCursor) at(i int) (key []byte, value []byte) {
+	if i < 0 {
+		c.i = -1
+		return nil, nil
+	}
+	if i >= len(c.bucket) {
+		c.i = len(c.bucket)
+		return nil, nil
+	}
+	c.i = i
+	return c.bucket[i].key, c.bucket[i].val
+}
+
+func (c *memCursor) First() (key []byte, value []byte) {
+	return c.at(0)
+}
+
+func (c *memCursor) Last() (key []byte, value []byte) {
+	return c.at(len(c.bucket) - 1)
+}
+
+func (c *memCursor) Seek(seek []byte) (key []byte, value []byte) {
+	return c.at(c.bucket.search(seek))
+}
+
+func (c *memCursor) Next() (key []byte, value []byte) {
+	return c.at(c.i + 1)
+}
+
+func (c *memCursor) Prev() (key []byte, value []byte) {
+	return c.at(c.i - 1)
+}
+
+// memRun is the mutations and deletions of one or more commits
+type memRun struct {
+	mutations memBucket
+	deletions memBucket
+	// keyspaces are the runs of the named keyspaces, with no keyspaces of
+	// their own
+	keyspaces map[string]*memRun
+	// size is the bytes of every key and value in the run
+	size int64
+}
+
+func (r *memRun) empty() bool {
+	return len(r.mutations) == 0 && len(r.deletions) == 0 && len(r.keyspaces) == 0
+}
+
+func (r *memRun) keyspace(name string) (mutations, deletions kvBucket) {
+	if name == "" {
+		return r.mutations, r.deletions
+	}
+	if keyspace, ok := r.keyspaces[name]; ok {
+		return keyspace.mutations, keyspace.deletions
+	}
+	return memBucket(nil), memBucket(nil)
+}
+
+func (r *memRun) keyspaceNames() []string {
+	rv := make([]string, 0, len(r.keyspaces))
+	for name := range r.keyspaces {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// keys returns the sorted keys mutated or deleted in each keyspace of the
+// run
+func (r *memRun) keys() keyspaceKeys {
+	rv := make(keyspaceKeys, len(r.keyspaces)+1)
+	rv[""] = r.ownKeys()
+	for name, keyspace := range r.keyspaces {
+		rv[name] = keyspace.ownKeys()
+	}
+	return rv
+}
+
+func (r *memRun) ownKeys() [][]byte {
+	rv := make([][]byte, 0, len(r.mutations)+len(r.deletions))
+	for _, kv := range r.mutations {
+		rv = append(rv, kv.key)
+	}
+	for _, kv := range r.deletions {
+		rv = append(rv, kv.key)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return bytes.Compare(rv[i], rv[j]) < 0
+	})
+	return rv
+}
+
+// mergeRuns combines runs, listed newest first, into one, keeping only
+// the newest entry for each key
+func mergeRuns(runs ...*memRun) *memRun {
+	if len(runs) == 1 {
+		return runs[0]
+	}
+	r := &reader{}
+	for i := len(runs) - 1; i >= 0; i-- {
+		r.overlay(runs[i])
+	}
+	rv := mergeRunKeyspace(r)
+	for _, name := range r.keyspaceNames() {
+		keyspace := mergeRunKeyspace(r.forKeyspace(name))
+		if rv.keyspaces == nil {
+			rv.keyspaces = make(map[string]*memRun)
+		}
+		rv.keyspaces[name] = keyspace
+		rv.size += keyspace.size
+	}
+	return rv
+}
+
+func mergeRunKeyspace(r *reader) *memRun {
+	rv := &memRun{}
+	c := newMergeCursor(r)
+	for k, v, deleted := c.Seek([]byte{}); k != nil; k, v, deleted = c.Next() {
+		if deleted {
+			rv.deletions = append(rv.deletions, memKV{key: k, val: []byte{}})
+		} else {
+			rv.mutations = append(rv.mutations, memKV{key: k, val: v})
+		}
+		rv.size += int64(len(k) + len(v))
+	}
+	return rv
+}
+
+// memBuffer holds the uncommitted writes of a transaction
+type memBuffer struct {
+	entries map[string]memKV
+	deleted map[string]bool
+	// keyspaces are the buffers of the named keyspaces
+	keyspaces map[string]*memBuffer
+
+	// run is the sorted view of entries, nil when out of date
+	run *memRun
+}
+
+func newMemBuffer() *memBuffer {
+	return &memBuffer{
+		entries: make(map[string]memKV),
+		deleted: make(map[string]bool),
+	}
+}
+
+// forKeyspace returns the buffer of a keyspace, "" is this one
+func (b *memBuffer) forKeyspace(name string) *memBuffer {
+	if name == "" {
+		return b
+	}
+	rv, ok := b.keyspaces[name]
+	if !ok {
+		if b.keyspaces == nil {
+			b.keyspaces = make(map[string]*memBuffer)
+		}
+		rv = newMemBuffer()
+		b.keyspaces[name] = rv
+	}
+	return rv
+}
+
+func checkKeyValue(key, value []byte) error {
+	if len(key) == 0 {
+		return bolt.ErrKeyRequired
+	} else if len(key) > bolt.MaxKeySize {
+		return bolt.ErrKeyTooLarge
+	} else if int64(len(value)) > bolt.MaxValueSize {
+		return bolt.ErrValueTooLarge
+	}
+	return nil
+}
+
+func (b *memBuffer) Put(key, val []byte) error {
+	err := checkKeyValue(key, val)
+	if err != nil {
+		return err
+	}
+	// copy, the caller may reuse key and val after the Put
+	b.entries[string(key)] = memKV{key: copyKey(key), val: append([]byte{}, val...)}
+	delete(b.deleted, string(key))
+	b.run = nil
+	return nil
+}
+
+func (b *memBuffer) Delete(key []byte) error {
+	err := checkKeyValue(key, nil)
+	if err != nil {
+		return err
+	}
+	b.entries[string(key)] = memKV{key: copyKey(key), val: []byte{}}
+	b.deleted[string(key)] = true
+	b.run = nil
+	return nil
+}
+
+// sorted returns the writes so far to this buffer as a run, without the
+// named keyspaces
+func (b *memBuffer) sorted() *memRun {
+	if b.run != nil {
+		return b.run
+	}
+	rv := &memRun{}
+	for key, kv := range b.entries {
+		if b.deleted[key] {
+			rv.deletions = append(rv.deletions, kv)
+		} else {
+			rv.mutations = append(rv.mutations, kv)
+		}
+		rv.size += int64(len(kv.key) + len(kv.val))
+	}
+	for _, bucket := range []memBucket{rv.mutations, rv.deletions} {
+		sort.Slice(bucket, func(i, j int) bool {
+			return bytes.Compare(bucket[i].key, bucket[j].key) < 0
+		})
+	}
+	b.run = rv
+	return rv
+}
+
+// commitRun returns every write to the buffer, including the named
+// keyspaces, as a run
+func (b *memBuffer) commitRun() *memRun {
+	own := b.sorted()
+	rv := &memRun{
+		mutations: own.mutations,
+		deletions: own.deletions,
+		size:      own.size,
+	}
+	for name, buffer := range b.keyspaces {
+		keyspace := buffer.sorted()
+		if len(keyspace.mutations) == 0 && len(keyspace.deletions) == 0 {
+			continue
+		}
+		if rv.keyspaces == nil {
+			rv.keyspaces = make(map[string]*memRun)
+		}
+		rv.keyspaces[name] = keyspace
+		rv.size += keyspace.size
+	}
+	return rv
+}
+
+func (b *memBuffer) keyspace(name string) (mutations, deletions kvBucket) {
+	buffer := b.forKeyspace(name)
+	return bufferBucket{buffer: buffer}, bufferBucket{buffer: buffer, deletions: true}
+}
+
+func (b *memBuffer) keyspaceNames() []string {
+	rv := make([]string, 0, len(b.keyspaces))
+	for name := range b.keyspaces {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// bufferBucket is a view of the mutations or deletions of a memBuffer,
+// which reflects later writes
+type bufferBucket struct {
+	buffer    *memBuffer
+	deletions bool
+}
+
+func (b bufferBucket) Get(key []byte) []byte {
+	kv, ok := b.buffer.entries[string(key)]
+	if !ok || b.buffer.deleted[string(key)] != b.deletions {
+		return nil
+	}
+	return kv.val
+}
+
+func (b bufferBucket) Cursor() kvCursor {
+	run := b.buffer.sorted()
+	if b.deletions {
+		return run.deletions.Cursor()
+	}
+	return run.mutations.Cursor()
+}
+
+// memtable is an immutable snapshot of the runs not yet in a segment,
+// the cellar replaces it as runs are committed and flushed
+type memtable struct {
+	// active runs are newest first, and may still be merged together
+	active []*memRun
+	// flushing runs are older than the active runs, and are being written
+	// to a segment
+	flushing []*memRun
+	// size is the bytes in the active runs
+	size int64
+}
+
+// overlay places the runs in front of the segments of the reader
+func (m *memtable) overlay(r *reader) {
+	if m == nil {
+		return
+	}
+	for i := len(m.flushing) - 1; i >= 0; i-- {
+		r.overlay(m.flushing[i])
+	}
+	for i := len(m.active) - 1; i >= 0; i-- {
+		r.overlay(m.active[i])
+	}
+}
+
+// push returns the memtable with run added as the newest
+func (m *memtable) push(run *memRun) *memtable {
+	active := append([]*memRun{run}, m.active...)
+	for len(active) > 1 && 2*active[0].size >= active[1].size {
+		merged := mergeRuns(active[0], active[1])
+		active = append([]*memRun{merged}, active[2:]...)
+	}
+	rv := &memtable{
+		active:   active,
+		flushing: m.flushing,
+	}
+	for _, run := range active {
+		rv.size += run.size
+	}
+	return rv
+}
+
+// getView returns the current root, with refs, and memtable, which
+// together reflect exactly the same commits
+func (c *Cellar) getView(reason ...string) (segmentList, *memtable) {
+	c.rootLock.RLock()
+	defer c.rootLock.RUnlock()
+	return c.getRootLocked(reason...), c.memtable
+}
+
+// pushMemRunLocked adds a committed run to the memtable
+// the caller must hold commitLock
+func (c *Cellar) pushMemRunLocked(run *memRun) error {
+	c.rootLock.RLock()
+	mem := c.memtable
+	closed := c.master == nil
+	c.rootLock.RUnlock()
+	if closed {
+		return ErrTxClosed
+	}
+	if run.empty() {
+		return nil
+	}
+
+	// merge runs without blocking readers, only commits change the runs
+	// which are not being flushed, and we hold commitLock
+	nmem := mem.push(run)
+
+	c.rootLock.Lock()
+	c.memtable = nmem
+	c.rootLock.Unlock()
+
+	if nmem.size >= c.options.MemtableSize {
+		select {
+		case c.flushChan <- struct{}{}:
+		default:
+			// flush already requested
+		}
+	}
+	return nil
+}
+
+// Flush writes every commit still in the memtable to a segment, it does
+// nothing if the memtable is not enabled
+func (c *Cellar) Flush() error {
+	if c.options.MemtableSize <= 0 {
+		return nil
+	}
+	c.flushLock.Lock()
+	defer c.flushLock.Unlock()
+	// the first flush may only finish an earlier failed one
+	for i := 0; i < 2; i++ {
+		err := c.flushMemtable()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// flushMemtable writes the flushing runs to a new segment, if there are
+// none, the active runs become the flushing runs first
+// the caller must hold flushLock
+func (c *Cellar) flushMemtable() error {
+	c.commitLock.Lock()
+	mem := c.memtable
+	if len(mem.flushing) == 0 && len(mem.active) > 0 {
+		// the log holds exactly the active runs, move it aside with them
+		err := c.wal.rotate()
+		if err != nil {
+			c.commitLock.Unlock()
+			return err
+		}
+		mem = &memtable{flushing: mem.active}
+		c.rootLock.Lock()
+		c.memtable = mem
+		c.rootLock.Unlock()
+	}
+	c.commitLock.Unlock()
+	if len(mem.flushing) == 0 {
+		return nil
+	}
+
+	newsegment, err := c.buildRunSegment(mergeRuns(mem.flushing...))
+	if err != nil {
+		return err
+	}
+
+	// the segment replaces the flushing runs, newer than every segment
+	// but older than the active runs
+	c.commitLock.Lock()
+	c.rootLock.Lock()
+	err = c.pushRootLocked(newsegment)
+	if err == nil {
+		c.memtable = &memtable{
+			active: c.memtable.active,
+			size:   c.memtable.size,
+		}
+	}
+	c.rootLock.Unlock()
+	c.commitLock.Unlock()
+	if err != nil {
+		removeSegments(segmentList{newsegment})
+		return err
+	}
+	return c.wal.flushed()
+}
+
+// buildRunSegment writes the run to a new segment, which is not yet live
+func (c *Cellar) buildRunSegment(run *memRun) (*segment, error) {
+	seq := atomic.AddUint64(&c.seq, 1)
+	segmentBuilder, err := newSegmentBuilder(c.path, seq, c.options)
+	if err != nil {
+		return nil, err
+	}
+	err = writeRun(run, segmentBuilder.Put, segmentBuilder.Delete)
+	for _, name := range run.keyspaceNames() {
+		if err != nil {
+			break
+		}
+		name := name
+		err = writeRun(run.keyspaces[name],
+			func(k, v []byte) error {
+				return segmentBuilder.PutKeyspace(name, k, v)
+			},
+			func(k []byte) error {
+				return segmentBuilder.DeleteKeyspace(name, k)
+			})
+	}
+	if err != nil {
+		segmentBuilder.discard()
+		return nil, err
+	}
+	newSegmentPath := segmentBuilder.path
+	err = segmentBuilder.Build()
+	if err != nil {
+		segmentBuilder.discard()
+		return nil, err
+	}
+	return openSegmentPath(newSegmentPath)
+}
+
+// writeRun writes the mutations and deletions of a run with put and del
+func writeRun(run *memRun, put func(k, v []byte) error, del func(k []byte) error) error {
+	for _, kv := range run.mutations {
+		err := put(kv.key, kv.val)
+		if err != nil {
+			return err
+		}
+	}
+	for _, kv := range run.deletions {
+		err := del(kv.key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runFlusher flushes the memtable when asked to by a commit, or when
+// interval has passed, until flushClose is closed
+func (c *Cellar) runFlusher(interval time.Duration) {
+	defer c.flushWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.flushClose:
+			return
+		case <-ticker.C:
+		case <-c.flushChan:
+		}
+		c.flushLock.Lock()
+		err := c.flushMemtable()
+		c.flushLock.Unlock()
+		if err != nil {
+			Logger.Printf("error flushing memtable: %v", err)
+		}
+	}
+}
@@ -0,0 +1,320 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func memtableOptions(size int64, interval time.Duration) *Options {
+	return &Options{
+		MemtableSize:          size,
+		MemtableFlushInterval: interval,
+	}
+}
+
+// countSegments returns the number of segments on the root
+func countSegments(c *Cellar) int {
+	root := c.getRoot("test count segments")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	return len(root)
+}
+
+func TestMemtable(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", memtableOptions(1<<30, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*10, i*10+10)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = c.Update(func(tx *Tx) error {
+		for i := 0; i < 100; i += 2 {
+			err := tx.Delete([]byte(fmt.Sprintf("k%016x", i)))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		err = c.View(func(tx *Tx) error {
+			checkNoKey(t, tx, fmt.Sprintf("k%016x", 0))
+			checkKey(t, tx, fmt.Sprintf("k%016x", 1), fmt.Sprintf("v%016x", 1))
+			checkCursor(t, tx, fmt.Sprintf("k%016x", 1), fmt.Sprintf("v%016x", 1),
+				fmt.Sprintf("k%016x", 99), fmt.Sprintf("v%016x", 99), 50)
+			cursor := tx.Cursor()
+			k, _ := cursor.Last()
+			k, _ = cursor.Prev()
+			if string(k) != fmt.Sprintf("k%016x", 97) {
+				t.Errorf("expected prev of last to be k%016x, got %s", 97, k)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// nothing has been written to a segment yet
+	if n := countSegments(c); n != 0 {
+		t.Errorf("expected no segments before flush, got %d", n)
+	}
+	check()
+
+	err = c.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := countSegments(c); n != 1 {
+		t.Errorf("expected 1 segment after flush, got %d", n)
+	}
+	check()
+
+	// writes in the memtable take priority over the segments
+	err = c.Update(func(tx *Tx) error {
+		err := tx.Put([]byte(fmt.Sprintf("k%016x", 0)), []byte("again"))
+		if err != nil {
+			return err
+		}
+		return tx.Delete([]byte(fmt.Sprintf("k%016x", 99)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.View(func(tx *Tx) error {
+		checkKey(t, tx, fmt.Sprintf("k%016x", 0), "again")
+		checkNoKey(t, tx, fmt.Sprintf("k%016x", 99))
+		checkCursor(t, tx, fmt.Sprintf("k%016x", 0), "again",
+			fmt.Sprintf("k%016x", 97), fmt.Sprintf("v%016x", 97), 50)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// close flushes the memtable
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.View(func(tx *Tx) error {
+		checkKey(t, tx, fmt.Sprintf("k%016x", 0), "again")
+		checkNoKey(t, tx, fmt.Sprintf("k%016x", 99))
+		checkCursor(t, tx, fmt.Sprintf("k%016x", 0), "again",
+			fmt.Sprintf("k%016x", 97), fmt.Sprintf("v%016x", 97), 50)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemtableReadOwnWrites(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", memtableOptions(1<<30, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 0, 5)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		err := putKvPairs(tx, 5, 10)
+		if err != nil {
+			return err
+		}
+		err = tx.Delete([]byte(fmt.Sprintf("k%016x", 0)))
+		if err != nil {
+			return err
+		}
+		checkNoKey(t, tx, fmt.Sprintf("k%016x", 0))
+		checkKey(t, tx, fmt.Sprintf("k%016x", 7), fmt.Sprintf("v%016x", 7))
+		checkCursor(t, tx, fmt.Sprintf("k%016x", 1), fmt.Sprintf("v%016x", 1),
+			fmt.Sprintf("k%016x", 9), fmt.Sprintf("v%016x", 9), 9)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rolled back writes never reach the memtable
+	tx, err := c.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Put([]byte(fmt.Sprintf("k%016x", 0)), []byte("rolled back"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, fmt.Sprintf("k%016x", 0))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemtableRunsMerged(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", memtableOptions(1<<30, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 1000; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i, i+1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.rootLock.RLock()
+	mem := c.memtable
+	c.rootLock.RUnlock()
+	if len(mem.active) > 11 {
+		t.Errorf("expected runs to be merged to at most 11, got %d", len(mem.active))
+	}
+	err = c.View(func(tx *Tx) error {
+		checkCursor(t, tx, fmt.Sprintf("k%016x", 0), fmt.Sprintf("v%016x", 0),
+			fmt.Sprintf("k%016x", 999), fmt.Sprintf("v%016x", 999), 1000)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMemtableFlushThresholds(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		interval time.Duration
+	}{
+		{"size", 100, time.Hour},
+		{"interval", 1 << 30, 10 * time.Millisecond},
+	}
+	for _, test := range tests {
+		func() {
+			defer os.RemoveAll("test")
+
+			c, err := Open("test", memtableOptions(test.size, test.interval))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+
+			err = c.Update(func(tx *Tx) error {
+				return putKvPairs(tx, 0, 10)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deadline := time.Now().Add(5 * time.Second)
+			for countSegments(c) != 1 {
+				if time.Now().After(deadline) {
+					t.Fatalf("%s: memtable not flushed", test.name)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			err = c.View(func(tx *Tx) error {
+				checkCursor(t, tx, fmt.Sprintf("k%016x", 0), fmt.Sprintf("v%016x", 0),
+					fmt.Sprintf("k%016x", 9), fmt.Sprintf("v%016x", 9), 10)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}()
+	}
+}
+
+func TestMemtableConflict(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", memtableOptions(1<<30, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tx1, err := c.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := c.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkNoKey(t, tx1, "k")
+	err = tx1.Put([]byte("k"), []byte("1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Put([]byte("k"), []byte("2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.Commit()
+	if err != ErrTxConflict {
+		t.Errorf("expected ErrTxConflict, got %v", err)
+	}
+	err = c.View(func(tx *Tx) error {
+		checkKey(t, tx, "k", "2")
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -12,73 +12,323 @@
 
 package cellar
 
-import "os"
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"time"
+)
 
 // Merge represents an ordered set of adjacent segments to be merged
 // dropDeletes specifies whether or not the deletes should be dropped
 // deletes can only be dropped if the result of the merge is the final segment
+// a ranged merge splits its output at start and end, and always drops
+// the deletes of keys in the range [start, end)
 type Merge struct {
 	cellar        *Cellar
 	newSegmentSeq uint64
+	sourceSeqs    []uint64
 	sources       segmentList
 	dropDeletes   bool
+
+	ranged bool
+	start  []byte
+	end    []byte
+
+	// cancel is closed when the merge should be aborted
+	cancel <-chan struct{}
+	// ctx is the context of the Compact or CompactRange call waiting on the
+	// merge, the merge is aborted once it is done, nil for other merges
+	ctx context.Context
+	// attempts is the number of times this merge has failed
+	attempts int
+
+	// progress of the merge, see ActiveMerges
+	started        time.Time
+	keysProcessed  uint64
+	bytesProcessed uint64
+}
+
+// NewMerge returns a Merge of the sources, which must be adjacent segments
+// listed in root order (newest first).  dropDeletes is only honored if the
+// last source is the final segment of the root.
+func NewMerge(sources []SegmentInfo, dropDeletes bool) *Merge {
+	rv := &Merge{
+		sourceSeqs:  make([]uint64, len(sources)),
+		dropDeletes: dropDeletes,
+	}
+	for i, source := range sources {
+		rv.sourceSeqs[i] = source.Seq
+	}
+	return rv
+}
+
+// Sources returns the seqs of the segments being merged
+func (m *Merge) Sources() []uint64 {
+	return m.sourceSeqs
 }
 
+// DropDeletes returns whether deletes are dropped by this merge
+func (m *Merge) DropDeletes() bool {
+	return m.dropDeletes
+}
+
+// resolve finds the sources of this merge on the root, checking that they
+// are adjacent and not already being merged
+func (m *Merge) resolve(root segmentList) error {
+	if len(m.sourceSeqs) == 0 {
+		return fmt.Errorf("merge has no sources")
+	}
+	start := -1
+	for i, segment := range root {
+		if segment.seq == m.sourceSeqs[0] {
+			start = i
+			break
+		}
+	}
+	if start < 0 || start+len(m.sourceSeqs) > len(root) {
+		return fmt.Errorf("merge sources %v not on root", m.sourceSeqs)
+	}
+	sources := root[start : start+len(m.sourceSeqs)]
+	for i, segment := range sources {
+		if segment.seq != m.sourceSeqs[i] {
+			return fmt.Errorf("merge sources %v not adjacent on root", m.sourceSeqs)
+		}
+		if atomic.LoadUint64(&segment.mergeInProgress) != 0 {
+			return fmt.Errorf("merge source %d already being merged", segment.seq)
+		}
+	}
+	if m.dropDeletes && start+len(sources) != len(root) {
+		// dropping deletes here would resurrect older values
+		Logger.Printf("merge %v does not produce the final segment, keeping deletes", m.sourceSeqs)
+		m.dropDeletes = false
+	}
+	m.sources = make(segmentList, len(sources))
+	copy(m.sources, sources)
+	return nil
+}
+
+// abandon gives up on the merge before its output is live, its sources
+// are released and can be chosen for another merge
+func (m *Merge) abandon(reason string) {
+	for _, segment := range m.sources {
+		atomic.StoreUint64(&segment.mergeInProgress, 0)
+		segment.decrRef(reason)
+	}
+}
+
+func (m *Merge) canceled() bool {
+	select {
+	case <-m.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// done returns the channel closed once ctx is done, or nil if the merge has
+// no ctx
+func (m *Merge) done() <-chan struct{} {
+	if m.ctx == nil {
+		return nil
+	}
+	return m.ctx.Done()
+}
+
+// closing returns true once the cellar is closing, the merge is abandoned
+// rather than holding up Close
+func (m *Merge) closing() bool {
+	select {
+	case <-m.cellar.mergeManager.closeChan:
+		return true
+	default:
+		return false
+	}
+}
+
+// doMerge builds the output of the merge and makes it live in place of the
+// sources.  If it fails, any output is removed and the sources are released
+// so that they can be chosen for another merge.
 func doMerge(m *Merge) error {
+	m.cellar.mergeManager.track(m)
+	defer m.cellar.mergeManager.untrack(m)
 
-	segmentBuilder, err := newSegmentBuilder(m.cellar.path, m.newSegmentSeq)
+	newsegs, err := buildMerge(m)
 	if err != nil {
+		m.abandon("merge failed")
 		return err
 	}
 
-	r, err := newReader(m.sources)
+	// make these segments live
+	err = m.cellar.replaceSegments(m.sources, newsegs)
 	if err != nil {
+		removeSegments(newsegs)
+		m.abandon("merge not made live")
 		return err
 	}
 
-	c := newMergeCursor(r)
-	k, v, deleted := c.Seek([]byte{})
-	for k != nil {
-		var err error
-		if deleted && !m.dropDeletes {
-			err = segmentBuilder.Delete(k)
-		} else if !deleted {
-			err = segmentBuilder.Put(k, v)
-		}
+	// release refs
+	for _, segment := range m.sources {
+		segment.decrRef("merge done")
+	}
+	return nil
+}
+
+// buildMerge builds the output segments of the merge, which are not yet live
+func buildMerge(m *Merge) (segmentList, error) {
+	r, err := newReader(m.sources)
+	if err != nil {
+		return nil, err
+	}
+
+	var newsegs segmentList
+	if !m.ranged {
+		newseg, err := buildMergeOutput(m, r, m.newSegmentSeq, []byte{}, nil, m.dropDeletes, false, true)
 		if err != nil {
-			return err
+			_ = r.Close()
+			return nil, err
+		}
+		newsegs = append(newsegs, newseg)
+	} else {
+		// split the output at the range boundaries, nothing older than the
+		// sources contains keys in the range, so its deletes can be dropped
+		// the range only applies to the default keyspace, the named
+		// keyspaces are all written to the first part
+		type part struct {
+			start, end  []byte
+			dropDeletes bool
+		}
+		var parts []part
+		if len(m.start) > 0 {
+			parts = append(parts, part{[]byte{}, m.start, m.dropDeletes})
+		}
+		parts = append(parts, part{m.start, m.end, true})
+		if m.end != nil {
+			parts = append(parts, part{m.end, nil, m.dropDeletes})
+		}
+		for i, p := range parts {
+			seq := m.newSegmentSeq
+			if i > 0 {
+				seq = atomic.AddUint64(&m.cellar.seq, 1)
+			}
+			newseg, err := buildMergeOutput(m, r, seq, p.start, p.end, p.dropDeletes, true, i == 0)
+			if err != nil {
+				removeSegments(newsegs)
+				_ = r.Close()
+				return nil, err
+			}
+			if newseg != nil {
+				newsegs = append(newsegs, newseg)
+			}
 		}
-		k, v, deleted = c.Next()
 	}
 	err = r.Close()
 	if err != nil {
-		return err
+		removeSegments(newsegs)
+		return nil, err
 	}
-	// decr refs on the sources		// release refs
-	for _, segment := range m.sources {
-		segment.decrRef("merge done")
+	return newsegs, nil
+}
+
+// removeSegments closes and deletes segments which were never made live
+func removeSegments(segments segmentList) {
+	for _, segment := range segments {
+		segmentPath := segment.Path()
+		_ = segment.Close()
+		_ = os.RemoveAll(segmentPath)
 	}
+}
 
-	newSegmentPath := segmentBuilder.db.Path()
-	err = segmentBuilder.Build()
+// buildMergeOutput builds a segment with seq from the keys of the merge in
+// the range [start, end), if skipEmpty is set and there are no keys to
+// write, no segment is built and nil is returned
+// if keyspaces is set, every key of the named keyspaces is also written,
+// dropping deletes only if the merge does
+func buildMergeOutput(m *Merge, r *reader, seq uint64, start, end []byte, dropDeletes, skipEmpty, keyspaces bool) (*segment, error) {
+	segmentBuilder, err := newSegmentBuilder(m.cellar.path, seq, m.cellar.options)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	newsegment, err := openSegmentPath(newSegmentPath)
+
+	if start == nil {
+		start = []byte{}
+	}
+	written, err := writeMergeRange(m, newMergeCursor(r), start, end, dropDeletes,
+		segmentBuilder.Put, segmentBuilder.Delete)
 	if err != nil {
-		return err
+		segmentBuilder.discard()
+		return nil, err
 	}
-	// make this segment live
-	err = m.cellar.replaceSegments(m.sources, newsegment)
+	if keyspaces {
+		for _, name := range r.keyspaceNames() {
+			name := name
+			keyspaceWritten, err := writeMergeRange(m, newMergeCursor(r.forKeyspace(name)), []byte{}, nil, m.dropDeletes,
+				func(k, v []byte) error {
+					return segmentBuilder.PutKeyspace(name, k, v)
+				},
+				func(k []byte) error {
+					return segmentBuilder.DeleteKeyspace(name, k)
+				})
+			if err != nil {
+				segmentBuilder.discard()
+				return nil, err
+			}
+			written += keyspaceWritten
+		}
+	}
+	if written == 0 && skipEmpty {
+		return nil, segmentBuilder.Abort()
+	}
+
+	newSegmentPath := segmentBuilder.path
+	err = segmentBuilder.Build()
 	if err != nil {
-		segmentPath := newsegment.Path()
-		// this segment was not made live, close it, delete it
-		_ = newsegment.Close()
-		// FIXME currently the merge segment will never be used
-		// so we delete it, however in the future, this could change
-		_ = os.RemoveAll(segmentPath)
-		return err
+		segmentBuilder.discard()
+		return nil, err
+	}
+	newseg, err := openSegmentPath(newSegmentPath)
+	if err != nil {
+		_ = os.Remove(newSegmentPath)
+		return nil, err
 	}
+	return newseg, nil
+}
 
-	return nil
+// writeMergeRange writes the keys of the merge cursor in the range
+// [start, end) with put and del, returning the number written
+func writeMergeRange(m *Merge, c *mergeCursor, start, end []byte, dropDeletes bool,
+	put func(k, v []byte) error, del func(k []byte) error) (int, error) {
+	var written int
+	k, v, deleted := c.SeekRange(start, end)
+	for k != nil {
+		if m.canceled() {
+			return written, ErrMergeCanceled
+		}
+		if m.closing() {
+			return written, ErrTxClosed
+		}
+		if m.ctx != nil && m.ctx.Err() != nil {
+			return written, m.ctx.Err()
+		}
+		var err error
+		var writtenBytes int
+		if deleted && !dropDeletes {
+			err = del(k)
+			written++
+			writtenBytes = len(k)
+		} else if !deleted {
+			err = put(k, v)
+			written++
+			writtenBytes = len(k) + len(v)
+		}
+		if err != nil {
+			return written, err
+		}
+		read, readKeys := c.read, c.readKeys
+		k, v, deleted = c.Next()
+		m.progress(c.readKeys-readKeys, c.read-read)
+		m.cellar.throttleMerge(m, c.read-read, writtenBytes)
+	}
+	return written, nil
 }
@@ -16,11 +16,17 @@ import (
 	"fmt"
 	"sync"
 	"sync/atomic"
+	"time"
 )
 
+// defaultMergeRetryBackoff is used when Options.MergeRetryBackoff is 0
+const defaultMergeRetryBackoff = time.Second
+
+// maxMergeRetryBackoff caps the delay before retrying a failed merge
+const maxMergeRetryBackoff = time.Minute
+
 type mergeManager struct {
 	cellar        *Cellar
-	changes       chan segmentList
 	closeChan     chan struct{}
 	mutex         sync.Mutex
 	running       bool
@@ -29,16 +35,45 @@ type mergeManager struct {
 	auto          bool
 	mergeWork     chan *Merge
 	maxConcurrent int
+	compactions   chan *compactRequest
+	retries       chan *Merge
+
+	// rootChanged signals Run that pendingRoot has been set, it is
+	// buffered so that notifying never blocks
+	rootChanged chan struct{}
+	// pendingRoot is the latest root not yet seen by Run, protected by mutex
+	// older roots are released as newer ones arrive
+	pendingRoot segmentList
+
+	// paused is set (atomically) while no new merges should start
+	paused int32
+	// cancelChan is closed to abort the merges started before, then replaced
+	cancelChan chan struct{}
+	// active are the merges in progress, protected by mutex
+	active map[*Merge]struct{}
+}
+
+// compactRequest asks the manager to claim the sources, a run of adjacent
+// segments on root, for a single merge, the reply is nil if any of them are
+// already being merged
+type compactRequest struct {
+	root    segmentList
+	sources segmentList
+	reply   chan *Merge
 }
 
-func newMergeManager(cellar *Cellar, policy MergePolicy, auto bool, maxConcurrent int) *mergeManager {
+func newMergeManager(cellar *Cellar, policy MergePolicy, auto bool, maxConcurrent int, queueDepth int) *mergeManager {
 	rv := &mergeManager{
-		changes:       make(chan segmentList),
+		rootChanged:   make(chan struct{}, 1),
 		closeChan:     make(chan struct{}),
 		running:       false,
 		policy:        policy,
 		auto:          auto,
-		mergeWork:     make(chan *Merge, 1024),
+		mergeWork:     make(chan *Merge, queueDepth),
+		compactions:   make(chan *compactRequest),
+		retries:       make(chan *Merge),
+		cancelChan:    make(chan struct{}),
+		active:        make(map[*Merge]struct{}),
 		cellar:        cellar,
 		maxConcurrent: maxConcurrent,
 	}
@@ -56,7 +91,7 @@ func (m *mergeManager) Start() error {
 	// start workers
 	for i := 0; i < m.maxConcurrent; i++ {
 		m.wg.Add(1)
-		go mergeWorker(&m.wg, m.mergeWork, m.closeChan)
+		go m.mergeWorker()
 	}
 	m.wg.Add(1)
 	go m.Run()
@@ -69,38 +104,138 @@ OUTER:
 		select {
 		case <-m.closeChan:
 			break OUTER
-		case newRoot, ok := <-m.changes:
-			if !ok {
-				break OUTER
+		case req := <-m.compactions:
+			req.reply <- m.claim(req.root, req.sources)
+		case <-m.rootChanged:
+			m.mutex.Lock()
+			newRoot := m.pendingRoot
+			m.pendingRoot = nil
+			m.mutex.Unlock()
+			if m.isPaused() {
+				for _, segment := range newRoot {
+					segment.decrRef("merges paused")
+				}
 			} else {
 				// roots changed, see if any merges should be done
-				merges := m.policy.Merges(m.cellar, newRoot)
+				merges := m.policy.Merges(m.cellar, newRoot.infos())
 				for _, merge := range merges {
-					// assign this merge a new segment seq
-					merge.newSegmentSeq = atomic.AddUint64(&m.cellar.seq, 1)
-					// set mergeInProgress so we don't keep merging the same segments
-					for _, s := range merge.sources {
-						s.mergeInProgress = merge.newSegmentSeq
-						// also incr ref count for each source
-						s.incrRef("merge work")
+					err := merge.resolve(newRoot)
+					if err != nil {
+						Logger.Printf("ignoring invalid merge: %v", err)
+						continue
 					}
-					m.mergeWork <- merge
+					m.dispatch(merge)
 				}
 				// release refs
 				for _, segment := range newRoot {
 					segment.decrRef("merge notification")
 				}
 			}
+		case merge := <-m.retries:
+			if m.isPaused() {
+				Logger.Printf("merges paused, dropping retry of %v", merge.sourceSeqs)
+				continue
+			}
+			root := m.cellar.getRoot("merge retry")
+			err := merge.resolve(root)
+			if err != nil {
+				// the policy will choose what to do with these segments now
+				Logger.Printf("dropping retry of merge: %v", err)
+			} else {
+				m.dispatch(merge)
+			}
+			for _, segment := range root {
+				segment.decrRef("merge retry")
+			}
 		}
 	}
 	m.wg.Done()
 }
 
+// dispatch hands a resolved merge to the workers
+func (m *mergeManager) dispatch(merge *Merge) {
+	merge.cellar = m.cellar
+	merge.cancel = m.cancelled()
+	// assign this merge a new segment seq
+	merge.newSegmentSeq = atomic.AddUint64(&m.cellar.seq, 1)
+	// set mergeInProgress so we don't keep merging the same segments
+	for _, s := range merge.sources {
+		atomic.StoreUint64(&s.mergeInProgress, merge.newSegmentSeq)
+		// also incr ref count for each source
+		s.incrRef("merge work")
+	}
+	select {
+	case m.mergeWork <- merge:
+	default:
+		// the workers are behind, the policy can choose it again later
+		Logger.Printf("merge queue full, dropping merge of %v", merge.sourceSeqs)
+		merge.abandon("merge queue full")
+	}
+}
+
+// claim builds a merge of the sources, marking them all as being merged,
+// or returns nil if any of them already are
+// deletes are dropped if the sources end with the final segment of root
+// it consumes the refs on root
+func (m *mergeManager) claim(root, sources segmentList) *Merge {
+	defer func() {
+		for _, segment := range root {
+			segment.decrRef("compact claim")
+		}
+	}()
+	for _, segment := range sources {
+		if atomic.LoadUint64(&segment.mergeInProgress) != 0 {
+			return nil
+		}
+	}
+	merge := &Merge{
+		cellar:        m.cellar,
+		newSegmentSeq: atomic.AddUint64(&m.cellar.seq, 1),
+		sources:       sources,
+		dropDeletes:   sources[len(sources)-1] == root[len(root)-1],
+		cancel:        m.cancelled(),
+	}
+	for _, s := range sources {
+		atomic.StoreUint64(&s.mergeInProgress, merge.newSegmentSeq)
+		s.incrRef("compact work")
+		merge.sourceSeqs = append(merge.sourceSeqs, s.seq)
+	}
+	return merge
+}
+
+// Compact claims the sources, a run of adjacent segments on root, for a
+// single merge, the refs on root are consumed, and nil is returned if some
+// of the sources are already being merged
+func (m *mergeManager) Compact(root, sources segmentList) (*Merge, error) {
+	req := &compactRequest{
+		root:    root,
+		sources: sources,
+		reply:   make(chan *Merge, 1),
+	}
+	select {
+	case <-m.closeChan:
+		for _, segment := range root {
+			segment.decrRef("compact closed")
+		}
+		return nil, ErrTxClosed
+	case m.compactions <- req:
+		return <-req.reply, nil
+	}
+}
+
 func (m *mergeManager) Stop() error {
 	Logger.Printf("staring to close merge manager")
 	close(m.closeChan)
 	m.wg.Wait()
 	Logger.Printf("done closing merge manager")
+	// release the root Run never got to
+	m.mutex.Lock()
+	pendingRoot := m.pendingRoot
+	m.pendingRoot = nil
+	m.mutex.Unlock()
+	for _, segment := range pendingRoot {
+		segment.decrRef("merge manager stopped")
+	}
 	// drain anything left on merge work and decr refs
 	close(m.mergeWork)
 OUTER:
@@ -118,9 +253,12 @@ OUTER:
 	return nil
 }
 
+// RootChange tells the manager about a new root, which it consumes
+// it never blocks, if the manager has not yet looked at the previous root,
+// that is released and only the new one is considered
 func (m *mergeManager) RootChange(root segmentList) {
 	if m.auto {
-		m.changes <- root
+		m.notify(root)
 	} else {
 		// release refs
 		for _, segment := range root {
@@ -129,26 +267,138 @@ func (m *mergeManager) RootChange(root segmentList) {
 	}
 }
 
+// ForceMerge consults the policy on root, even without automatic merging
 func (m *mergeManager) ForceMerge(root segmentList) {
-	m.changes <- root
+	m.notify(root)
+}
+
+func (m *mergeManager) notify(root segmentList) {
+	m.mutex.Lock()
+	select {
+	case <-m.closeChan:
+		m.mutex.Unlock()
+		for _, segment := range root {
+			segment.decrRef("merge manager stopped")
+		}
+		return
+	default:
+	}
+	prevRoot := m.pendingRoot
+	m.pendingRoot = root
+	m.mutex.Unlock()
+	for _, segment := range prevRoot {
+		segment.decrRef("root change coalesced")
+	}
+	select {
+	case m.rootChanged <- struct{}{}:
+	default:
+		// Run has already been signaled
+	}
 }
 
-func mergeWorker(wg *sync.WaitGroup, workChan chan *Merge, closeChan chan struct{}) {
+// Pause stops any new merges from being started, including those already
+// chosen by the policy but still waiting for a worker
+func (m *mergeManager) Pause() {
+	atomic.StoreInt32(&m.paused, 1)
+}
+
+// Resume allows merges to be started again, the root is consumed and if
+// automatic merging is on, the policy is consulted on it straight away
+func (m *mergeManager) Resume(root segmentList) {
+	atomic.StoreInt32(&m.paused, 0)
+	m.RootChange(root)
+}
+
+func (m *mergeManager) isPaused() bool {
+	return atomic.LoadInt32(&m.paused) != 0
+}
+
+// Cancel aborts every merge started before it was called
+func (m *mergeManager) Cancel() {
+	m.mutex.Lock()
+	close(m.cancelChan)
+	m.cancelChan = make(chan struct{})
+	m.mutex.Unlock()
+}
+
+// cancelled returns the channel which will be closed by the next Cancel
+func (m *mergeManager) cancelled() <-chan struct{} {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.cancelChan
+}
+
+func (m *mergeManager) mergeWorker() {
 OUTER:
 	for {
 		select {
-		case <-closeChan:
+		case <-m.closeChan:
 			break OUTER
-		case work, ok := <-workChan:
+		case work, ok := <-m.mergeWork:
 			if !ok {
 				break OUTER
 			}
+			if m.isPaused() {
+				// the policy can choose it again once resumed
+				work.abandon("merges paused")
+				continue
+			}
 			err := doMerge(work)
 			if err != nil {
-				Logger.Printf("MERGE ERROR: %v", err)
+				m.failed(work, err)
 			}
 		}
 	}
-	wg.Done()
+	m.wg.Done()
 	Logger.Printf("merge worker done")
 }
+
+// failed records a failed background merge and schedules a retry
+// doMerge has already released its sources
+func (m *mergeManager) failed(merge *Merge, err error) {
+	if err == ErrMergeCanceled || err == ErrTxClosed {
+		Logger.Printf("merge of %v stopped: %v", merge.sourceSeqs, err)
+		return
+	}
+	merge.attempts++
+	atomic.AddUint64(&m.cellar.stats.mergesFailed, 1)
+	mergeErr := &MergeError{
+		Sources: merge.sourceSeqs,
+		Attempt: merge.attempts,
+		Err:     err,
+	}
+	Logger.Printf("MERGE ERROR: %v", mergeErr)
+	if m.cellar.options.MergeErrorCallback != nil {
+		m.cellar.options.MergeErrorCallback(mergeErr)
+	}
+
+	backoff := m.retryBackoff(merge.attempts)
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+		select {
+		case <-m.closeChan:
+		case <-time.After(backoff):
+			select {
+			case <-m.closeChan:
+			case m.retries <- merge:
+			}
+		}
+	}()
+}
+
+// retryBackoff returns the delay before retrying a merge which has failed
+// attempts times
+func (m *mergeManager) retryBackoff(attempts int) time.Duration {
+	backoff := m.cellar.options.MergeRetryBackoff
+	if backoff <= 0 {
+		backoff = defaultMergeRetryBackoff
+	}
+	for i := 1; i < attempts && backoff < maxMergeRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxMergeRetryBackoff {
+		backoff = maxMergeRetryBackoff
+	}
+	return backoff
+}
@@ -13,8 +13,10 @@
 package cellar
 
 // MergePolicy is anything which can prescribe a set of Merges to be done
+// segments are in root order, newest first, and Merges are built with NewMerge
+// segments with MergeInProgress set must not be included in any Merge
 type MergePolicy interface {
-	Merges(*Cellar, segmentList) []*Merge
+	Merges(*Cellar, []SegmentInfo) []*Merge
 }
 
 // SimpleMergePolicy has no brain at all, it simply always chooses to merge
@@ -22,30 +24,311 @@ type MergePolicy interface {
 type SimpleMergePolicy struct{}
 
 // Merges returns the set of prescribed merge operations for this set of segments
-func (s *SimpleMergePolicy) Merges(cellar *Cellar, segments segmentList) []*Merge {
+func (s *SimpleMergePolicy) Merges(cellar *Cellar, segments []SegmentInfo) []*Merge {
 	//rv := make([]*Merge, 0)
 	var rv []*Merge
-	consecutive := make(segmentList, 0)
+	consecutive := make([]SegmentInfo, 0)
 	for i := len(segments) - 1; i >= 0; i-- {
 		segment := segments[i]
-		if segment.mergeInProgress == 0 {
+		if !segment.MergeInProgress {
 			// insert, not append to keep the order the same (we're iterating reverse)
-			consecutive = append(consecutive, nil)
+			consecutive = append(consecutive, SegmentInfo{})
 			copy(consecutive[1:], consecutive[:])
 			consecutive[0] = segment
 			if len(consecutive) == 2 {
-				rv = append(rv, &Merge{
-					cellar:      cellar,
-					sources:     consecutive,
-					dropDeletes: (i == len(segments)-2), // if merging last 2 segments, we can drop deletes
-				})
-				consecutive = make(segmentList, 0)
+				// if merging last 2 segments, we can drop deletes
+				rv = append(rv, NewMerge(consecutive, i == len(segments)-2))
+				consecutive = make([]SegmentInfo, 0)
 			}
 		} else {
 			// found a segment with merge in progress, so start over
-			consecutive = make(segmentList, 0)
+			consecutive = make([]SegmentInfo, 0)
 		}
 	}
 
 	return rv
 }
+
+// TieredMergePolicy groups adjacent segments of similar size into tiers, and
+// merges a tier once it has accumulated enough segments.  Small segments are
+// merged with each other until they are large enough to join the next tier,
+// rather than being merged into much larger segments over and over.
+// Zero values for the settings select the defaults.
+type TieredMergePolicy struct {
+	// FanIn is the number of segments a tier must have before it is merged
+	// defaults to 4
+	FanIn int
+	// MinMergeWidth is the fewest segments merged at once, defaults to 2
+	MinMergeWidth int
+	// MaxMergeWidth is the most segments merged at once, defaults to 10
+	MaxMergeWidth int
+	// SizeRatio is the largest ratio between the sizes of the largest and
+	// smallest segment within a tier, defaults to 4
+	SizeRatio float64
+}
+
+func (t *TieredMergePolicy) settings() (fanIn, minWidth, maxWidth int, sizeRatio float64) {
+	fanIn, minWidth, maxWidth, sizeRatio = t.FanIn, t.MinMergeWidth, t.MaxMergeWidth, t.SizeRatio
+	if minWidth < 2 {
+		minWidth = 2
+	}
+	if fanIn <= 0 {
+		fanIn = 4
+	}
+	if fanIn < minWidth {
+		fanIn = minWidth
+	}
+	if maxWidth <= 0 {
+		maxWidth = 10
+	}
+	if maxWidth < minWidth {
+		maxWidth = minWidth
+	}
+	if sizeRatio < 1 {
+		sizeRatio = 4
+	}
+	return fanIn, minWidth, maxWidth, sizeRatio
+}
+
+// Merges returns the set of prescribed merge operations for this set of segments
+func (t *TieredMergePolicy) Merges(cellar *Cellar, segments []SegmentInfo) []*Merge {
+	fanIn, minWidth, maxWidth, sizeRatio := t.settings()
+
+	var rv []*Merge
+	// tier is in root order, built up from the oldest segment
+	var tier []SegmentInfo
+	var tierMin, tierMax int64
+	var tierIncludesLast bool
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		if segment.MergeInProgress {
+			// segment with merge in progress ends the tier
+			rv = append(rv, mergeTier(tier, tierIncludesLast, fanIn, minWidth, maxWidth)...)
+			tier = nil
+			continue
+		}
+		if len(tier) > 0 {
+			newMin, newMax := tierMin, tierMax
+			if segment.Size < newMin {
+				newMin = segment.Size
+			}
+			if segment.Size > newMax {
+				newMax = segment.Size
+			}
+			if float64(newMax) > float64(newMin)*sizeRatio {
+				// too different in size, start a new tier
+				rv = append(rv, mergeTier(tier, tierIncludesLast, fanIn, minWidth, maxWidth)...)
+				tier = nil
+			} else {
+				tierMin, tierMax = newMin, newMax
+			}
+		}
+		if len(tier) == 0 {
+			tierMin, tierMax = segment.Size, segment.Size
+			tierIncludesLast = i == len(segments)-1
+		}
+		// insert, not append to keep the order the same (we're iterating reverse)
+		tier = append(tier, SegmentInfo{})
+		copy(tier[1:], tier[:])
+		tier[0] = segment
+	}
+	rv = append(rv, mergeTier(tier, tierIncludesLast, fanIn, minWidth, maxWidth)...)
+
+	return rv
+}
+
+// mergeTier splits a tier (in root order) into merges, starting from the
+// oldest segments, once the tier has at least fanIn segments
+func mergeTier(tier []SegmentInfo, includesLast bool, fanIn, minWidth, maxWidth int) []*Merge {
+	if len(tier) < fanIn {
+		return nil
+	}
+	var rv []*Merge
+	for len(tier) >= minWidth {
+		width := len(tier)
+		if width > maxWidth {
+			width = maxWidth
+		}
+		// only the merge including the last segment can drop deletes
+		rv = append(rv, NewMerge(tier[len(tier)-width:], includesLast))
+		includesLast = false
+		tier = tier[:len(tier)-width]
+	}
+	return rv
+}
+
+// LeveledMergePolicy keeps the segments on the root in a geometric series of
+// levels, bounding read amplification.  A segment's level is determined by
+// its size, level L holding segments up to BaseSize * Ratio^L bytes.  Each
+// level above 0 holds a single segment, and level 0 holds at most
+// Level0Segments segments.  When a level overflows its segments are merged,
+// and the result is merged upward into the next level once it is as large.
+// Once merges complete, the root holds at most Level0Segments segments plus
+// one segment per level, and deletes are always dropped when a merge
+// produces the final segment.
+// Zero values for the settings select the defaults.
+type LeveledMergePolicy struct {
+	// BaseSize is the largest size of a level 0 segment in bytes
+	// defaults to 4MB
+	BaseSize int64
+	// Ratio is how many times larger each level is than the previous one
+	// defaults to 10
+	Ratio int
+	// Level0Segments is the most segments level 0 can hold, defaults to 4
+	Level0Segments int
+}
+
+func (l *LeveledMergePolicy) settings() (baseSize int64, ratio int, level0Segments int) {
+	baseSize, ratio, level0Segments = l.BaseSize, l.Ratio, l.Level0Segments
+	if baseSize <= 0 {
+		baseSize = 4 << 20
+	}
+	if ratio < 2 {
+		ratio = 10
+	}
+	if level0Segments <= 0 {
+		level0Segments = 4
+	}
+	return baseSize, ratio, level0Segments
+}
+
+func (l *LeveledMergePolicy) level(size int64) int {
+	baseSize, ratio, _ := l.settings()
+	rv := 0
+	for capacity := baseSize; size > capacity; capacity *= int64(ratio) {
+		rv++
+	}
+	return rv
+}
+
+// levelRun is a maximal run of adjacent idle segments on the same level
+type levelRun struct {
+	level        int
+	segments     []SegmentInfo // root order
+	includesLast bool
+	// olderAdjacent is true if the next older run is directly adjacent
+	olderAdjacent bool
+	merged        bool
+}
+
+// Merges returns the set of prescribed merge operations for this set of segments
+func (l *LeveledMergePolicy) Merges(cellar *Cellar, segments []SegmentInfo) []*Merge {
+	_, _, level0Segments := l.settings()
+
+	// build the runs, oldest first
+	var runs []*levelRun
+	var curr *levelRun
+	adjacent := false
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		if segment.MergeInProgress {
+			curr = nil
+			adjacent = false
+			continue
+		}
+		level := l.level(segment.Size)
+		if curr == nil || curr.level != level {
+			curr = &levelRun{
+				level:         level,
+				includesLast:  i == len(segments)-1,
+				olderAdjacent: adjacent,
+			}
+			runs = append(runs, curr)
+		}
+		// insert, not append to keep the order the same (we're iterating reverse)
+		curr.segments = append(curr.segments, SegmentInfo{})
+		copy(curr.segments[1:], curr.segments[:])
+		curr.segments[0] = segment
+		adjacent = true
+	}
+
+	var rv []*Merge
+	for i, run := range runs {
+		if run.merged {
+			continue
+		}
+		if (run.level > 0 && len(run.segments) > 1) ||
+			(run.level == 0 && len(run.segments) > level0Segments) {
+			// this level has overflowed
+			rv = append(rv, NewMerge(run.segments, run.includesLast))
+			run.merged = true
+			continue
+		}
+		if i > 0 && run.olderAdjacent && !runs[i-1].merged && run.level > runs[i-1].level {
+			// this segment outgrew the older level, merge it upward
+			older := runs[i-1]
+			sources := append(append([]SegmentInfo{}, run.segments...), older.segments...)
+			rv = append(rv, NewMerge(sources, older.includesLast))
+			run.merged = true
+			older.merged = true
+		}
+	}
+
+	return rv
+}
+
+// TombstoneMergePolicy wraps another MergePolicy, prioritising merges which
+// let deletes be dropped.  Once a segment's tombstone ratio passes Threshold,
+// it is merged together with every older segment, producing the final
+// segment so the deletes can be dropped.  The remaining segments are left to
+// the wrapped policy.
+// Zero values for the settings select the defaults.
+type TombstoneMergePolicy struct {
+	// Policy is the wrapped policy, defaults to SimpleMergePolicy
+	Policy MergePolicy
+	// Threshold is the tombstone ratio at which a segment is prioritised
+	// defaults to 0.5
+	Threshold float64
+	// MinDeletions is the fewest deletes a segment must have to be
+	// prioritised, defaults to 1
+	MinDeletions uint64
+	// MaxMergeWidth is the most segments merged at once to drop deletes,
+	// defaults to unlimited
+	MaxMergeWidth int
+}
+
+// Merges returns the set of prescribed merge operations for this set of segments
+func (t *TombstoneMergePolicy) Merges(cellar *Cellar, segments []SegmentInfo) []*Merge {
+	policy := t.Policy
+	if policy == nil {
+		policy = &SimpleMergePolicy{}
+	}
+	threshold := t.Threshold
+	if threshold <= 0 {
+		threshold = 0.5
+	}
+	minDeletions := t.MinDeletions
+	if minDeletions == 0 {
+		minDeletions = 1
+	}
+
+	// find the newest dense segment which can be merged down to the final
+	// segment, without crossing a merge in progress
+	start := -1
+	for i := len(segments) - 1; i >= 0; i-- {
+		segment := segments[i]
+		if segment.MergeInProgress {
+			break
+		}
+		if t.MaxMergeWidth > 0 && len(segments)-i > t.MaxMergeWidth {
+			break
+		}
+		if segment.Deletions >= minDeletions && segment.TombstoneRatio() >= threshold {
+			start = i
+		}
+	}
+	// NOTE: if start is the final segment, it is merged on its own, which
+	// simply drops its deletes
+	if start < 0 {
+		return policy.Merges(cellar, segments)
+	}
+
+	rv := []*Merge{NewMerge(segments[start:], true)}
+	// the wrapped policy must not touch the segments we're merging
+	remaining := make([]SegmentInfo, len(segments))
+	copy(remaining, segments)
+	for i := start; i < len(remaining); i++ {
+		remaining[i].MergeInProgress = true
+	}
+	return append(rv, policy.Merges(cellar, remaining)...)
+}
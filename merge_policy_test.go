@@ -19,127 +19,99 @@ import (
 
 func TestMergePolicy(t *testing.T) {
 	tests := []struct {
-		input  segmentList
+		input  []SegmentInfo
 		output []*Merge
 	}{
 		// no segments = no merges
 		{
-			input:  segmentList{},
+			input:  []SegmentInfo{},
 			output: nil,
 		},
 		// 1 segment, nothing to merge
 		{
-			input: segmentList{
-				&segment{
-					seq: 1,
+			input: []SegmentInfo{
+				{
+					Seq: 1,
 				},
 			},
 			output: nil,
 		},
 		// 2 segment, 1 merge
 		{
-			input: segmentList{
-				&segment{
-					seq: 2,
+			input: []SegmentInfo{
+				{
+					Seq: 2,
 				},
-				&segment{
-					seq: 1,
+				{
+					Seq: 1,
 				},
 			},
 			output: []*Merge{
 				&Merge{
-					sources: segmentList{
-						&segment{
-							seq: 2,
-						},
-						&segment{
-							seq: 1,
-						},
-					},
+					sourceSeqs:  []uint64{2, 1},
 					dropDeletes: true,
 				},
 			},
 		},
 		// 3 segment, without 2 consecutive
 		{
-			input: segmentList{
-				&segment{
-					seq: 3,
+			input: []SegmentInfo{
+				{
+					Seq: 3,
 				},
-				&segment{
-					seq:             2,
-					mergeInProgress: 4,
+				{
+					Seq:             2,
+					MergeInProgress: true,
 				},
-				&segment{
-					seq: 1,
+				{
+					Seq: 1,
 				},
 			},
 			output: nil,
 		},
 		// 3 segments, oldest 2 get merged
 		{
-			input: segmentList{
-				&segment{
-					seq: 3,
+			input: []SegmentInfo{
+				{
+					Seq: 3,
 				},
-				&segment{
-					seq: 2,
+				{
+					Seq: 2,
 				},
-				&segment{
-					seq: 1,
+				{
+					Seq: 1,
 				},
 			},
 			output: []*Merge{
 				&Merge{
-					sources: segmentList{
-						&segment{
-							seq: 2,
-						},
-						&segment{
-							seq: 1,
-						},
-					},
+					sourceSeqs:  []uint64{2, 1},
 					dropDeletes: true,
 				},
 			},
 		},
 		// 4 segments, 2 merges
 		{
-			input: segmentList{
-				&segment{
-					seq: 4,
+			input: []SegmentInfo{
+				{
+					Seq: 4,
 				},
-				&segment{
-					seq: 3,
+				{
+					Seq: 3,
 				},
-				&segment{
-					seq: 2,
+				{
+					Seq: 2,
 				},
-				&segment{
-					seq: 1,
+				{
+					Seq: 1,
 				},
 			},
 			output: []*Merge{
 				&Merge{
-					sources: segmentList{
-						&segment{
-							seq: 2,
-						},
-						&segment{
-							seq: 1,
-						},
-					},
+					sourceSeqs:  []uint64{2, 1},
 					dropDeletes: true,
 				},
 				&Merge{
-					sources: segmentList{
-						&segment{
-							seq: 4,
-						},
-						&segment{
-							seq: 3,
-						},
-					},
+					sourceSeqs:  []uint64{4, 3},
 					dropDeletes: false,
 				},
 			},
@@ -155,3 +127,427 @@ func TestMergePolicy(t *testing.T) {
 	}
 
 }
+
+func TestMergeResolve(t *testing.T) {
+	root := segmentList{
+		&segment{seq: 4},
+		&segment{seq: 3, mergeInProgress: 5},
+		&segment{seq: 2},
+		&segment{seq: 1},
+	}
+
+	tests := []struct {
+		merge       *Merge
+		valid       bool
+		dropDeletes bool
+	}{
+		{
+			merge:       NewMerge([]SegmentInfo{{Seq: 2}, {Seq: 1}}, true),
+			valid:       true,
+			dropDeletes: true,
+		},
+		// single segment merges are fine, for dropping deletes
+		{
+			merge:       NewMerge([]SegmentInfo{{Seq: 1}}, true),
+			valid:       true,
+			dropDeletes: true,
+		},
+		// deletes are kept if the merge doesn't produce the final segment
+		{
+			merge:       NewMerge([]SegmentInfo{{Seq: 4}}, true),
+			valid:       true,
+			dropDeletes: false,
+		},
+		// no sources
+		{
+			merge: NewMerge(nil, false),
+			valid: false,
+		},
+		// not adjacent
+		{
+			merge: NewMerge([]SegmentInfo{{Seq: 4}, {Seq: 2}}, false),
+			valid: false,
+		},
+		// wrong order
+		{
+			merge: NewMerge([]SegmentInfo{{Seq: 1}, {Seq: 2}}, false),
+			valid: false,
+		},
+		// already being merged
+		{
+			merge: NewMerge([]SegmentInfo{{Seq: 3}, {Seq: 2}}, false),
+			valid: false,
+		},
+		// not on root
+		{
+			merge: NewMerge([]SegmentInfo{{Seq: 7}}, false),
+			valid: false,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.merge.resolve(root)
+		if (err == nil) != test.valid {
+			t.Errorf("expected merge %v valid %t, got err %v", test.merge.Sources(), test.valid, err)
+			continue
+		}
+		if err == nil && test.merge.DropDeletes() != test.dropDeletes {
+			t.Errorf("expected merge %v drop deletes %t, got %t", test.merge.Sources(), test.dropDeletes, test.merge.DropDeletes())
+		}
+		if err == nil && len(test.merge.sources) != len(test.merge.Sources()) {
+			t.Errorf("expected merge %v to resolve %d sources, got %d", test.merge.Sources(), len(test.merge.Sources()), len(test.merge.sources))
+		}
+	}
+}
+
+func TestTieredMergePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *TieredMergePolicy
+		input  []SegmentInfo
+		output []*Merge
+	}{
+		{
+			name:   "no segments",
+			policy: &TieredMergePolicy{},
+			input:  []SegmentInfo{},
+			output: nil,
+		},
+		{
+			name:   "tier below fan in",
+			policy: &TieredMergePolicy{FanIn: 4},
+			input: []SegmentInfo{
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 10},
+				{Seq: 1, Size: 10},
+			},
+			output: nil,
+		},
+		{
+			name:   "tier at fan in, includes last segment",
+			policy: &TieredMergePolicy{FanIn: 3},
+			input: []SegmentInfo{
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 12},
+				{Seq: 1, Size: 9},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{3, 2, 1}, dropDeletes: true},
+			},
+		},
+		{
+			name:   "small segments are not merged into a large one",
+			policy: &TieredMergePolicy{FanIn: 3, SizeRatio: 2},
+			input: []SegmentInfo{
+				{Seq: 5, Size: 10},
+				{Seq: 4, Size: 10},
+				{Seq: 3, Size: 11},
+				{Seq: 2, Size: 1000},
+				{Seq: 1, Size: 1100},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{5, 4, 3}, dropDeletes: false},
+			},
+		},
+		{
+			name:   "merge in progress splits tiers",
+			policy: &TieredMergePolicy{FanIn: 2},
+			input: []SegmentInfo{
+				{Seq: 6, Size: 10},
+				{Seq: 5, Size: 10},
+				{Seq: 4, Size: 10, MergeInProgress: true},
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 10, MergeInProgress: true},
+				{Seq: 1, Size: 10, MergeInProgress: true},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{6, 5}, dropDeletes: false},
+			},
+		},
+		{
+			name:   "wide tier split by max width, oldest first",
+			policy: &TieredMergePolicy{FanIn: 3, MinMergeWidth: 2, MaxMergeWidth: 3},
+			input: []SegmentInfo{
+				{Seq: 8, Size: 10},
+				{Seq: 7, Size: 10},
+				{Seq: 6, Size: 10},
+				{Seq: 5, Size: 10},
+				{Seq: 4, Size: 10},
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 10},
+				{Seq: 1, Size: 100},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{4, 3, 2}, dropDeletes: false},
+				&Merge{sourceSeqs: []uint64{7, 6, 5}, dropDeletes: false},
+			},
+		},
+		{
+			name:   "remainder merged if at least min width",
+			policy: &TieredMergePolicy{FanIn: 3, MinMergeWidth: 2, MaxMergeWidth: 3},
+			input: []SegmentInfo{
+				{Seq: 5, Size: 10},
+				{Seq: 4, Size: 10},
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 10},
+				{Seq: 1, Size: 10},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{3, 2, 1}, dropDeletes: true},
+				&Merge{sourceSeqs: []uint64{5, 4}, dropDeletes: false},
+			},
+		},
+		{
+			name:   "defaults",
+			policy: &TieredMergePolicy{},
+			input: []SegmentInfo{
+				{Seq: 5, Size: 10},
+				{Seq: 4, Size: 20},
+				{Seq: 3, Size: 30},
+				{Seq: 2, Size: 40},
+				{Seq: 1, Size: 1000},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{5, 4, 3, 2}, dropDeletes: false},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		actual := test.policy.Merges(nil, test.input)
+		if !reflect.DeepEqual(actual, test.output) {
+			t.Errorf("%s: expected %v, got %v", test.name, mergeSeqs(test.output), mergeSeqs(actual))
+		}
+	}
+}
+
+func mergeSeqs(merges []*Merge) [][]uint64 {
+	var rv [][]uint64
+	for _, merge := range merges {
+		rv = append(rv, merge.Sources())
+	}
+	return rv
+}
+
+func TestLeveledMergePolicy(t *testing.T) {
+	policy := &LeveledMergePolicy{BaseSize: 100, Ratio: 10, Level0Segments: 2}
+
+	tests := []struct {
+		name   string
+		input  []SegmentInfo
+		output []*Merge
+	}{
+		{
+			name:   "no segments",
+			input:  []SegmentInfo{},
+			output: nil,
+		},
+		{
+			name: "level 0 not yet full",
+			input: []SegmentInfo{
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 10},
+				{Seq: 1, Size: 5000},
+			},
+			output: nil,
+		},
+		{
+			name: "level 0 overflows",
+			input: []SegmentInfo{
+				{Seq: 4, Size: 10},
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 10},
+				{Seq: 1, Size: 5000},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{4, 3, 2}, dropDeletes: false},
+			},
+		},
+		{
+			name: "level 1 holds 2 segments, includes last",
+			input: []SegmentInfo{
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 200},
+				{Seq: 1, Size: 300},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{2, 1}, dropDeletes: true},
+			},
+		},
+		{
+			name: "newer segment outgrew older level, merged upward",
+			input: []SegmentInfo{
+				{Seq: 3, Size: 10},
+				{Seq: 2, Size: 5000},
+				{Seq: 1, Size: 200},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{2, 1}, dropDeletes: true},
+			},
+		},
+		{
+			name: "merge in progress blocks merging across it",
+			input: []SegmentInfo{
+				{Seq: 4, Size: 200},
+				{Seq: 3, Size: 200, MergeInProgress: true},
+				{Seq: 2, Size: 200},
+				{Seq: 1, Size: 50},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{2, 1}, dropDeletes: true},
+			},
+		},
+		{
+			name: "already leveled",
+			input: []SegmentInfo{
+				{Seq: 5, Size: 10},
+				{Seq: 4, Size: 50},
+				{Seq: 3, Size: 500},
+				{Seq: 2, Size: 5000},
+				{Seq: 1, Size: 50000},
+			},
+			output: nil,
+		},
+	}
+
+	for _, test := range tests {
+		actual := policy.Merges(nil, test.input)
+		if !reflect.DeepEqual(actual, test.output) {
+			t.Errorf("%s: expected %v, got %v", test.name, mergeSeqs(test.output), mergeSeqs(actual))
+		}
+	}
+}
+
+// applyMerges simulates merges on a root of segment infos, the merged
+// segment is as large as its sources combined
+func applyMerges(root []SegmentInfo, merges []*Merge, seq *uint64) []SegmentInfo {
+	for _, merge := range merges {
+		sources := merge.Sources()
+		var rv []SegmentInfo
+		for i := 0; i < len(root); i++ {
+			if root[i].Seq != sources[0] {
+				rv = append(rv, root[i])
+				continue
+			}
+			*seq++
+			merged := SegmentInfo{Seq: *seq}
+			for j := range sources {
+				merged.Size += root[i+j].Size
+			}
+			rv = append(rv, merged)
+			i += len(sources) - 1
+		}
+		root = rv
+	}
+	return root
+}
+
+func TestLeveledMergePolicyBoundsSegments(t *testing.T) {
+	policy := &LeveledMergePolicy{BaseSize: 100, Ratio: 4, Level0Segments: 3}
+
+	var root []SegmentInfo
+	var seq uint64
+	for i := 0; i < 1000; i++ {
+		// flush a new small segment
+		seq++
+		root = append([]SegmentInfo{{Seq: seq, Size: 30}}, root...)
+		// run merges until the policy is satisfied
+		for merges := policy.Merges(nil, root); len(merges) > 0; merges = policy.Merges(nil, root) {
+			root = applyMerges(root, merges, &seq)
+		}
+
+		var total int64
+		for _, segment := range root {
+			total += segment.Size
+		}
+		bound := 3 + policy.level(total) + 1
+		if len(root) > bound {
+			t.Fatalf("after %d flushes, expected at most %d segments, got %d", i+1, bound, len(root))
+		}
+	}
+}
+
+func TestTombstoneMergePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *TombstoneMergePolicy
+		input  []SegmentInfo
+		output []*Merge
+	}{
+		{
+			name:   "no dense segments, wrapped policy decides",
+			policy: &TombstoneMergePolicy{Policy: &TieredMergePolicy{FanIn: 4}},
+			input: []SegmentInfo{
+				{Seq: 3, Mutations: 10, Deletions: 1},
+				{Seq: 2, Mutations: 10},
+				{Seq: 1, Mutations: 10},
+			},
+			output: nil,
+		},
+		{
+			name:   "dense segment merged down to the final segment",
+			policy: &TombstoneMergePolicy{Policy: &TieredMergePolicy{FanIn: 4}},
+			input: []SegmentInfo{
+				{Seq: 4, Mutations: 10},
+				{Seq: 3, Mutations: 2, Deletions: 8},
+				{Seq: 2, Mutations: 10},
+				{Seq: 1, Mutations: 10},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{3, 2, 1}, dropDeletes: true},
+			},
+		},
+		{
+			name:   "final segment alone drops its deletes, rest to wrapped policy",
+			policy: &TombstoneMergePolicy{},
+			input: []SegmentInfo{
+				{Seq: 3, Mutations: 10},
+				{Seq: 2, Mutations: 10},
+				{Seq: 1, Mutations: 1, Deletions: 9},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{1}, dropDeletes: true},
+				&Merge{sourceSeqs: []uint64{3, 2}, dropDeletes: false},
+			},
+		},
+		{
+			name:   "merge in progress blocks reaching the final segment",
+			policy: &TombstoneMergePolicy{Policy: &TieredMergePolicy{FanIn: 4}},
+			input: []SegmentInfo{
+				{Seq: 3, Mutations: 2, Deletions: 8},
+				{Seq: 2, Mutations: 10, MergeInProgress: true},
+				{Seq: 1, Mutations: 10},
+			},
+			output: nil,
+		},
+		{
+			name:   "threshold and min deletions",
+			policy: &TombstoneMergePolicy{Policy: &TieredMergePolicy{FanIn: 4}, Threshold: 0.25, MinDeletions: 5},
+			input: []SegmentInfo{
+				{Seq: 3, Mutations: 1, Deletions: 4},
+				{Seq: 2, Mutations: 15, Deletions: 5},
+				{Seq: 1, Mutations: 10},
+			},
+			output: []*Merge{
+				&Merge{sourceSeqs: []uint64{2, 1}, dropDeletes: true},
+			},
+		},
+		{
+			name:   "max merge width",
+			policy: &TombstoneMergePolicy{Policy: &TieredMergePolicy{FanIn: 4}, MaxMergeWidth: 2},
+			input: []SegmentInfo{
+				{Seq: 3, Mutations: 2, Deletions: 8},
+				{Seq: 2, Mutations: 10},
+				{Seq: 1, Mutations: 10},
+			},
+			output: nil,
+		},
+	}
+
+	for _, test := range tests {
+		actual := test.policy.Merges(nil, test.input)
+		if !reflect.DeepEqual(actual, test.output) {
+			t.Errorf("%s: expected %v, got %v", test.name, mergeSeqs(test.output), mergeSeqs(actual))
+		}
+	}
+}
@@ -0,0 +1,127 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// MergeProgress describes a merge in progress, as returned by ActiveMerges
+type MergeProgress struct {
+	// Sources are the seqs of the segments being merged, newest first
+	Sources []uint64
+	// Target is the seq of the segment being built
+	Target uint64
+	// KeysProcessed and BytesProcessed count the keys, and the bytes of
+	// keys and values, read from the sources so far
+	KeysProcessed  uint64
+	BytesProcessed uint64
+	// KeysTotal is the number of keys in the sources, the merge is done
+	// once it has processed about this many
+	KeysTotal uint64
+	// Elapsed is the time since the merge started
+	Elapsed time.Duration
+	// DropDeletes is true if the merge drops deletes
+	DropDeletes bool
+}
+
+// progress records that the merge has read more keys from its sources
+func (m *Merge) progress(keys, bytes int) {
+	atomic.AddUint64(&m.keysProcessed, uint64(keys))
+	atomic.AddUint64(&m.bytesProcessed, uint64(bytes))
+}
+
+func (m *Merge) progressSnapshot(now time.Time) MergeProgress {
+	var keysTotal uint64
+	for _, segment := range m.sources {
+		keysTotal += segment.mutations + segment.deletions
+	}
+	return MergeProgress{
+		Sources:        m.sourceSeqs,
+		Target:         m.newSegmentSeq,
+		KeysProcessed:  atomic.LoadUint64(&m.keysProcessed),
+		BytesProcessed: atomic.LoadUint64(&m.bytesProcessed),
+		KeysTotal:      keysTotal,
+		Elapsed:        now.Sub(m.started),
+		DropDeletes:    m.dropDeletes,
+	}
+}
+
+// track adds the merge to the active merges until untrack is called
+// a retried merge starts its progress over
+func (m *mergeManager) track(merge *Merge) {
+	merge.started = time.Now()
+	atomic.StoreUint64(&merge.keysProcessed, 0)
+	atomic.StoreUint64(&merge.bytesProcessed, 0)
+	m.mutex.Lock()
+	m.active[merge] = struct{}{}
+	m.mutex.Unlock()
+}
+
+func (m *mergeManager) untrack(merge *Merge) {
+	m.mutex.Lock()
+	delete(m.active, merge)
+	m.mutex.Unlock()
+}
+
+// ActiveMerges returns the progress of every merge in progress, including
+// those started by Compact and CompactRange, ordered by target seq
+func (c *Cellar) ActiveMerges() []MergeProgress {
+	now := time.Now()
+	m := c.mergeManager
+	m.mutex.Lock()
+	rv := make([]MergeProgress, 0, len(m.active))
+	for merge := range m.active {
+		rv = append(rv, merge.progressSnapshot(now))
+	}
+	m.mutex.Unlock()
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].Target < rv[j].Target
+	})
+	return rv
+}
+
+// StatsResponse is the body served by StatsHandler
+type StatsResponse struct {
+	Segments        uint64
+	MergesCompleted uint64
+	MergesFailed    uint64
+	MergeThrottled  time.Duration
+	ActiveMerges    []MergeProgress
+}
+
+// StatsHandler returns an http.Handler serving the Stats and ActiveMerges
+// of the cellar as JSON.  Nothing is served unless the application mounts
+// it, it is meant to be served on a local address only, for use by tools
+// such as cellar stats.
+func (c *Cellar) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stats := c.Stats()
+		rv := &StatsResponse{
+			Segments:        stats.Segments(),
+			MergesCompleted: stats.MergesCompleted(),
+			MergesFailed:    stats.MergesFailed(),
+			MergeThrottled:  stats.MergeThrottled(),
+			ActiveMerges:    c.ActiveMerges(),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(rv)
+		if err != nil {
+			Logger.Printf("error writing stats: %v", err)
+		}
+	})
+}
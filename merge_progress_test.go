@@ -0,0 +1,141 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestActiveMerges(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	options := *testOptionsNoAutoMerge
+	// slow enough to watch the merge progress
+	options.MergeWriteRate = 4096
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 4; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.ActiveMerges()) != 0 {
+		t.Fatalf("expected no active merges yet")
+	}
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- c.Compact(context.Background())
+	}()
+
+	var active []MergeProgress
+	for len(active) == 0 || active[0].KeysProcessed == 0 {
+		runtime.Gosched()
+		active = c.ActiveMerges()
+	}
+	progress := active[0]
+	if !reflect.DeepEqual(progress.Sources, []uint64{4, 3, 2, 1}) || progress.Target != 5 {
+		t.Errorf("expected merge of [4 3 2 1] into 5, got %v into %d", progress.Sources, progress.Target)
+	}
+	if progress.KeysTotal != 400 || progress.KeysProcessed > progress.KeysTotal {
+		t.Errorf("expected up to 400 keys, got %d of %d", progress.KeysProcessed, progress.KeysTotal)
+	}
+	if progress.BytesProcessed == 0 || progress.Elapsed <= 0 || !progress.DropDeletes {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+
+	// the same is served over http
+	w := httptest.NewRecorder()
+	c.StatsHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var resp StatsResponse
+	err = json.NewDecoder(w.Body).Decode(&resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Segments != 4 || len(resp.ActiveMerges) != 1 || resp.ActiveMerges[0].Target != 5 {
+		t.Errorf("unexpected stats response %+v", resp)
+	}
+
+	c.SetMergeWriteRate(0)
+	err = <-errChan
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c.ActiveMerges()) != 0 {
+		t.Errorf("expected no active merges after compact, got %v", c.ActiveMerges())
+	}
+}
+
+func TestActiveMergesRetry(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	errs := make(chan *MergeError, 10)
+	options := *testOptionsNoAutoMerge
+	options.MergeRetryBackoff = 100 * time.Millisecond
+	options.MergeErrorCallback = func(err *MergeError) {
+		errs <- err
+	}
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the first attempt reads every key, then fails
+	blockNextSegment(t, c)
+	c.ForceMerge()
+	<-errs
+
+	// slow enough to watch the retry
+	c.SetMergeWriteRate(1024)
+	var active []MergeProgress
+	for len(active) == 0 || active[0].KeysProcessed == 0 {
+		runtime.Gosched()
+		active = c.ActiveMerges()
+	}
+	progress := active[0]
+	if progress.KeysTotal != 200 || progress.KeysProcessed >= progress.KeysTotal {
+		t.Errorf("expected retry to start its progress over, got %d of %d keys", progress.KeysProcessed, progress.KeysTotal)
+	}
+	if progress.BytesProcessed >= 200*34 {
+		t.Errorf("expected retry to start its progress over, got %d bytes", progress.BytesProcessed)
+	}
+
+	c.SetMergeWriteRate(0)
+	for c.Stats().MergesCompleted() == 0 {
+		runtime.Gosched()
+	}
+}
@@ -13,9 +13,16 @@
 package cellar
 
 import (
+	"context"
+	"fmt"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var testOptionsNoAutoMerge = &Options{
@@ -880,3 +887,820 @@ func checkWithIterator(t *testing.T, tx *Tx, pairs [][]string) {
 	}
 
 }
+
+func benchmarkMergeCursorScan(b *testing.B, segments int) {
+	defer os.RemoveAll("test")
+
+	c := buildBenchCellar(b, segments, 10000/segments)
+	defer c.Close()
+
+	root := c.getRoot("benchmark merge cursor")
+	defer func() {
+		for _, segment := range root {
+			segment.decrRef("benchmark done")
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r, err := newReader(root)
+		if err != nil {
+			b.Fatal(err)
+		}
+		mc := newMergeCursor(r)
+		for k, _, _ := mc.Seek([]byte{}); k != nil; k, _, _ = mc.Next() {
+		}
+		err = r.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMergeCursorScan1Segment(b *testing.B)   { benchmarkMergeCursorScan(b, 1) }
+func BenchmarkMergeCursorScan4Segments(b *testing.B)  { benchmarkMergeCursorScan(b, 4) }
+func BenchmarkMergeCursorScan16Segments(b *testing.B) { benchmarkMergeCursorScan(b, 16) }
+func BenchmarkMergeCursorScan64Segments(b *testing.B) { benchmarkMergeCursorScan(b, 64) }
+
+// mergeAllPolicy merges every segment into one once there are enough
+type mergeAllPolicy struct {
+	min int
+
+	// infos is appended to by the merge manager, and read by the test
+	infosLock sync.Mutex
+	infos     [][]SegmentInfo
+}
+
+func (p *mergeAllPolicy) Merges(cellar *Cellar, segments []SegmentInfo) []*Merge {
+	p.infosLock.Lock()
+	p.infos = append(p.infos, segments)
+	p.infosLock.Unlock()
+	if len(segments) < p.min {
+		return nil
+	}
+	for _, segment := range segments {
+		if segment.MergeInProgress {
+			return nil
+		}
+	}
+	return []*Merge{NewMerge(segments, true)}
+}
+
+func TestMergeCustomPolicy(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	policy := &mergeAllPolicy{min: 3}
+	c, err := Open("test", &Options{
+		AutomaticMerge: true,
+		MergePolicy:    policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	numMergesBefore := c.Stats().mergesCompleted
+	for i := 0; i < 3; i++ {
+		err = c.Update(func(tx *Tx) error {
+			err := putKvPairs(tx, i*100, (i+1)*100)
+			if err != nil {
+				return err
+			}
+			return tx.Delete([]byte("k0000000000000000"))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for c.Stats().mergesCompleted <= numMergesBefore {
+		runtime.Gosched()
+	}
+
+	root := c.getRoot("TestMergeCustomPolicy")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	if len(root) != 1 {
+		t.Fatalf("expected only 1 segment in root now, got %d", len(root))
+	}
+	info := root[0].info(time.Now())
+	if info.Mutations != 299 || info.Deletions != 0 {
+		t.Errorf("expected 299 mutations and 0 deletions, got %d and %d", info.Mutations, info.Deletions)
+	}
+
+	// the policy saw accurate descriptions of the segments, root changes
+	// may be coalesced, but the oldest segment is always the first written
+	policy.infosLock.Lock()
+	first := policy.infos[0]
+	policy.infosLock.Unlock()
+	oldest := first[len(first)-1]
+	if oldest.Seq != 1 || oldest.Mutations != 99 || oldest.Deletions != 1 || oldest.Size <= 0 {
+		t.Errorf("unexpected segment info %+v", oldest)
+	}
+	if string(oldest.MinKey) != "k0000000000000000" || string(oldest.MaxKey) != "k0000000000000063" {
+		t.Errorf("unexpected segment info key range [%s %s]", oldest.MinKey, oldest.MaxKey)
+	}
+
+	c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, "k0000000000000000")
+		checkCursor(t, tx, "k0000000000000001", "v0000000000000001", "k000000000000012b", "v000000000000012b", 299)
+		return nil
+	})
+}
+
+func TestMergeTieredPolicy(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", &Options{
+		AutomaticMerge: true,
+		MergePolicy:    &TieredMergePolicy{FanIn: 3},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for c.Stats().mergesCompleted == 0 {
+		runtime.Gosched()
+	}
+
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k00000000000007cf", "v00000000000007cf", 2000)
+		return nil
+	})
+}
+
+func TestCompact(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// nothing to do on an empty cellar
+	err = c.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		err = c.Update(func(tx *Tx) error {
+			err := putKvPairs(tx, i*100, (i+1)*100)
+			if err != nil {
+				return err
+			}
+			return tx.Delete([]byte(fmt.Sprintf("k%016x", i*100-1)))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = c.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := c.getRoot("TestCompact")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	if len(root) != 1 {
+		t.Fatalf("expected only 1 segment in root now, got %d", len(root))
+	}
+	if root[0].deletions != 0 {
+		t.Errorf("expected compacted segment to have no deletions, got %d", root[0].deletions)
+	}
+	if c.Stats().mergesCompleted != 1 {
+		t.Errorf("expected 1 merge completed, got %d", c.Stats().mergesCompleted)
+	}
+
+	c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, "k0000000000000063")
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k00000000000001f3", "v00000000000001f3", 496)
+		return nil
+	})
+
+	// compacting again is a no-op
+	err = c.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().mergesCompleted != 1 {
+		t.Errorf("expected still 1 merge completed, got %d", c.Stats().mergesCompleted)
+	}
+
+	// a done context is reported
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = c.Compact(ctx)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestCompactWithAutomaticMerge(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 20; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// merges already in flight must finish first
+	err = c.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := c.getRoot("TestCompactWithAutomaticMerge")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	if len(root) != 1 {
+		t.Fatalf("expected only 1 segment in root now, got %d", len(root))
+	}
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k00000000000007cf", "v00000000000007cf", 2000)
+		return nil
+	})
+}
+
+func putPrefixed(tx *Tx, prefix string, n int) error {
+	for i := 0; i < n; i++ {
+		k := fmt.Sprintf("%s%04d", prefix, i)
+		err := tx.Put([]byte(k), []byte("v"+k))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func deletePrefixed(tx *Tx, prefix string, from, to int) error {
+	for i := from; i < to; i++ {
+		err := tx.Delete([]byte(fmt.Sprintf("%s%04d", prefix, i)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCompactRange(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	updates := []func(tx *Tx) error{
+		func(tx *Tx) error { return putPrefixed(tx, "c", 10) },
+		func(tx *Tx) error {
+			err := putPrefixed(tx, "a", 10)
+			if err != nil {
+				return err
+			}
+			return putPrefixed(tx, "b", 10)
+		},
+		func(tx *Tx) error { return deletePrefixed(tx, "b", 0, 10) },
+		func(tx *Tx) error { return putPrefixed(tx, "d", 10) },
+	}
+	for _, update := range updates {
+		err = c.Update(update)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	before := c.getRoot("TestCompactRange")
+	for _, segment := range before {
+		segment.decrRef("test done with refs")
+	}
+
+	err = c.CompactRange(context.Background(), []byte("b"), []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := c.getRoot("TestCompactRange")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	// the b segments are gone, the a keys rewritten, the c and d untouched
+	if len(root) != 3 {
+		t.Fatalf("expected 3 segments in root now, got %d", len(root))
+	}
+	if root[0] != before[0] || root[2] != before[3] {
+		t.Errorf("expected segments outside the range to be untouched")
+	}
+	if root[1].mutations != 10 || root[1].deletions != 0 {
+		t.Errorf("expected rewritten segment to have 10 mutations, 0 deletions, got %d, %d", root[1].mutations, root[1].deletions)
+	}
+
+	c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, "b0000")
+		checkKey(t, tx, "a0000", "va0000")
+		checkKey(t, tx, "c0009", "vc0009")
+		checkCursor(t, tx, "a0000", "va0000", "d0009", "vd0009", 30)
+		return nil
+	})
+
+	// compacting the range again is a no-op
+	completed := c.Stats().mergesCompleted
+	err = c.CompactRange(context.Background(), []byte("b"), []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().mergesCompleted != completed {
+		t.Errorf("expected no more merges, got %d", c.Stats().mergesCompleted-completed)
+	}
+}
+
+func TestCompactRangeInvalid(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		start, end string
+	}{
+		{
+			name:  "empty",
+			start: "k0000000000000032",
+			end:   "k0000000000000032",
+		},
+		{
+			name:  "inverted",
+			start: "k0000000000000096",
+			end:   "k0000000000000032",
+		},
+	}
+	for _, test := range tests {
+		err = c.CompactRange(context.Background(), []byte(test.start), []byte(test.end))
+		if err != ErrInvalidRange {
+			t.Errorf("%s: expected ErrInvalidRange, got %v", test.name, err)
+		}
+	}
+	if countSegments(c) != 2 {
+		t.Errorf("expected the segments to be left alone, got %d", countSegments(c))
+	}
+	if c.Stats().MergesCompleted() != 0 {
+		t.Errorf("expected no merges, got %d", c.Stats().MergesCompleted())
+	}
+}
+
+func TestCompactRangeSplitsOutput(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Update(func(tx *Tx) error {
+		for _, prefix := range []string{"a", "b", "c"} {
+			err := putPrefixed(tx, prefix, 10)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		for _, prefix := range []string{"a", "b", "c"} {
+			err := deletePrefixed(tx, prefix, 0, 5)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.CompactRange(context.Background(), []byte("b"), []byte("c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := c.getRoot("TestCompactRangeSplitsOutput")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	if len(root) != 3 {
+		t.Fatalf("expected 3 segments in root now, got %d", len(root))
+	}
+	// the merge produced the final segment, so all deletes are dropped
+	for i, prefix := range []string{"a", "b", "c"} {
+		if string(root[i].minKey) != prefix+"0005" || string(root[i].maxKey) != prefix+"0009" {
+			t.Errorf("expected segment %d to span %s0005-%s0009, got %s-%s", i, prefix, prefix, root[i].minKey, root[i].maxKey)
+		}
+		if root[i].mutations != 5 || root[i].deletions != 0 {
+			t.Errorf("expected segment %d to have 5 mutations, 0 deletions, got %d, %d", i, root[i].mutations, root[i].deletions)
+		}
+	}
+
+	c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, "b0004")
+		checkCursor(t, tx, "a0005", "va0005", "c0009", "vc0009", 15)
+		return nil
+	})
+}
+
+func TestMergePauseResume(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.PauseMerges()
+	c.ForceMerge()
+	time.Sleep(50 * time.Millisecond)
+	if c.Stats().mergesCompleted != 0 {
+		t.Fatalf("expected no merges while paused, got %d", c.Stats().mergesCompleted)
+	}
+
+	c.ResumeMerges()
+	c.ForceMerge()
+	for c.Stats().mergesCompleted == 0 {
+		runtime.Gosched()
+	}
+
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k00000000000000c7", "v00000000000000c7", 200)
+		return nil
+	})
+}
+
+func TestMergeCancel(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	options := *testOptionsNoAutoMerge
+	// slow enough that the merge is still running when canceled
+	options.MergeWriteRate = 1024
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 4; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := c.getRoot("TestMergeCancel")
+	for _, segment := range before {
+		segment.decrRef("test done with refs")
+	}
+
+	errChan := make(chan error)
+	go func() {
+		errChan <- c.Compact(context.Background())
+	}()
+	time.Sleep(50 * time.Millisecond)
+	c.CancelMerges()
+	err = <-errChan
+	if err != ErrMergeCanceled {
+		t.Fatalf("expected ErrMergeCanceled, got %v", err)
+	}
+
+	// the sources are still on the root, and free to be merged again
+	root := c.getRoot("TestMergeCancel")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	if !reflect.DeepEqual(root, before) {
+		t.Errorf("expected root to be unchanged")
+	}
+	for _, segment := range root {
+		if segment.mergeInProgress != 0 {
+			t.Errorf("expected segment %d to not be merging", segment.seq)
+		}
+	}
+	tempFiles, err := filepath.Glob(filepath.Join("test", "*"+segmentTempSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tempFiles) != 0 {
+		t.Errorf("expected partial segment to be removed, found %v", tempFiles)
+	}
+
+	c.SetMergeWriteRate(0)
+	err = c.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k000000000000018f", "v000000000000018f", 400)
+		return nil
+	})
+}
+
+// blockNextSegment makes building the next segment fail, by putting a
+// directory where its file would be renamed to
+func blockNextSegment(t *testing.T, c *Cellar) {
+	path := filepath.Join(c.path, segmentFilename(atomic.LoadUint64(&c.seq)+1))
+	err := os.Mkdir(path, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMergeFailureRetry(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	errs := make(chan *MergeError, 10)
+	options := *testOptionsNoAutoMerge
+	options.MergeRetryBackoff = 10 * time.Millisecond
+	options.MergeErrorCallback = func(err *MergeError) {
+		errs <- err
+	}
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blockNextSegment(t, c)
+	c.ForceMerge()
+
+	select {
+	case mergeErr := <-errs:
+		if mergeErr.Attempt != 1 || !reflect.DeepEqual(mergeErr.Sources, []uint64{2, 1}) {
+			t.Errorf("expected first failure of merge of [2 1], got %v", mergeErr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the merge to fail")
+	}
+
+	// the retry gets a new seq, so succeeds
+	deadline := time.Now().Add(5 * time.Second)
+	for c.Stats().MergesCompleted() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the retried merge to complete")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if c.Stats().MergesFailed() != 1 {
+		t.Errorf("expected 1 failed merge, got %d", c.Stats().MergesFailed())
+	}
+	tempFiles, err := filepath.Glob(filepath.Join("test", "*"+segmentTempSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tempFiles) != 0 {
+		t.Errorf("expected failed segment to be removed, found %v", tempFiles)
+	}
+
+	root := c.getRoot("TestMergeFailureRetry")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	if len(root) != 1 {
+		t.Fatalf("expected only 1 segment in root now, got %d", len(root))
+	}
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k00000000000000c7", "v00000000000000c7", 200)
+		return nil
+	})
+}
+
+func TestCompactFailureReleasesSources(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := c.getRoot("TestCompactFailureReleasesSources")
+	for _, segment := range before {
+		segment.decrRef("test done with refs")
+	}
+
+	blockNextSegment(t, c)
+	err = c.Compact(context.Background())
+	if err == nil {
+		t.Fatalf("expected error compacting")
+	}
+
+	root := c.getRoot("TestCompactFailureReleasesSources")
+	for _, segment := range root {
+		segment.decrRef("test done with refs")
+	}
+	if !reflect.DeepEqual(root, before) {
+		t.Errorf("expected root to be unchanged")
+	}
+	for _, segment := range root {
+		if segment.mergeInProgress != 0 {
+			t.Errorf("expected segment %d to not be merging", segment.seq)
+		}
+	}
+
+	err = c.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k00000000000000c7", "v00000000000000c7", 200)
+		return nil
+	})
+}
+
+func TestCompactContextCanceledMidMerge(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	// 1 byte per second, each key would hold up the merge for many seconds
+	options := *testOptionsNoAutoMerge
+	options.MergeWriteRate = 1
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := c.getRoot("TestCompactContextCanceledMidMerge")
+	sources := make(map[string]bool)
+	for _, segment := range before {
+		sources[segment.Path()] = true
+		segment.decrRef("test done with refs")
+	}
+
+	tests := []struct {
+		name    string
+		compact func(ctx context.Context) error
+	}{
+		{
+			name:    "compact",
+			compact: c.Compact,
+		},
+		{
+			name: "compact range",
+			compact: func(ctx context.Context) error {
+				return c.CompactRange(ctx, []byte("k0000000000000032"), []byte("k0000000000000096"))
+			},
+		},
+	}
+	for _, test := range tests {
+		ctx, cancel := context.WithCancel(context.Background())
+		errs := make(chan error, 1)
+		go func() {
+			errs <- test.compact(ctx)
+		}()
+		// let the merge start sleeping
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+		select {
+		case err = <-errs:
+			if err != context.Canceled {
+				t.Errorf("%s: expected context.Canceled, got %v", test.name, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: expected canceling the context to interrupt the merge", test.name)
+		}
+
+		root := c.getRoot("TestCompactContextCanceledMidMerge")
+		for _, segment := range root {
+			segment.decrRef("test done with refs")
+		}
+		if !reflect.DeepEqual(root, before) {
+			t.Errorf("%s: expected root to be unchanged", test.name)
+		}
+		for _, segment := range root {
+			if segment.mergeInProgress != 0 {
+				t.Errorf("%s: expected segment %d to not be merging", test.name, segment.seq)
+			}
+		}
+		files, err := filepath.Glob(filepath.Join("test", segmentPrefix+"*"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, file := range files {
+			if !sources[file] {
+				t.Errorf("%s: expected the partial output to be removed, found %s", test.name, file)
+			}
+		}
+	}
+}
+
+func TestMergeQueueFullDoesNotBlockCommits(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", &Options{
+		AutomaticMerge:  true,
+		MergeWorkers:    1,
+		MergeQueueDepth: 1,
+		// keep the one worker busy for the whole test
+		MergeWriteRate: 1024,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	start := time.Now()
+	for i := 0; i < 50; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected commits not to wait for merges, took %v", elapsed)
+	}
+
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k0000000000001387", "v0000000000001387", 5000)
+		return nil
+	})
+
+	// don't wait for the slow merges to finish
+	c.PauseMerges()
+	c.CancelMerges()
+}
@@ -14,43 +14,173 @@ package cellar
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/boltdb/bolt"
 )
 
+// kvBucket is the read-only view of a mutations or deletions bucket
+// needed by readers and cursors, a bolt bucket or an in-memory one
+type kvBucket interface {
+	Get(key []byte) []byte
+	Cursor() kvCursor
+}
+
+// kvCursor is the subset of bolt.Cursor used to iterate a kvBucket
+type kvCursor interface {
+	First() (key []byte, value []byte)
+	Last() (key []byte, value []byte)
+	Seek(seek []byte) (key []byte, value []byte)
+	Next() (key []byte, value []byte)
+	Prev() (key []byte, value []byte)
+}
+
+// boltBucket adapts a bolt.Bucket to kvBucket
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+func (b boltBucket) Cursor() kvCursor {
+	return b.Bucket.Cursor()
+}
+
+// kvSource provides the mutations and deletions buckets of each keyspace,
+// "" is the default keyspace, see Tx.Keyspace
+type kvSource interface {
+	keyspace(name string) (mutations, deletions kvBucket)
+	// keyspaceNames returns the sorted names of the named keyspaces
+	keyspaceNames() []string
+}
+
+// boltSource is the keyspaces of a segment, or of a segment being built
+type boltSource struct {
+	tx *bolt.Tx
+}
+
+func (s boltSource) keyspace(name string) (mutations, deletions kvBucket) {
+	mutationsBucket, deletionsBucket := segmentKeyspace(s.tx, name)
+	if mutationsBucket == nil || deletionsBucket == nil {
+		return memBucket(nil), memBucket(nil)
+	}
+	return boltBucket{mutationsBucket}, boltBucket{deletionsBucket}
+}
+
+func (s boltSource) keyspaceNames() []string {
+	return segmentKeyspaceNames(s.tx)
+}
+
 type reader struct {
-	root      segmentList
+	root segmentList
+	// keyspace is the keyspace read, "" for the default
+	keyspace string
+	// segments parallels sources, which parallels mutations/deletions
+	// segments are nil for an overlay, and for a named keyspace, as their
+	// bloom filters and key ranges only describe the default keyspace
+	segments  []*segment
+	sources   []kvSource
 	txs       []*bolt.Tx
-	mutations []*bolt.Bucket
-	deletions []*bolt.Bucket
+	mutations []kvBucket
+	deletions []kvBucket
 }
 
 func newReader(root segmentList) (*reader, error) {
 	rv := &reader{
 		root:      root,
+		segments:  make([]*segment, 0, len(root)),
+		sources:   make([]kvSource, 0, len(root)),
 		txs:       make([]*bolt.Tx, 0, len(root)),
-		mutations: make([]*bolt.Bucket, 0, len(root)),
-		deletions: make([]*bolt.Bucket, 0, len(root)),
+		mutations: make([]kvBucket, 0, len(root)),
+		deletions: make([]kvBucket, 0, len(root)),
 	}
 
 	for _, segment := range root {
 		tx, err := segment.DB.Begin(false)
 		if err != nil {
+			_ = rv.Close()
 			return nil, fmt.Errorf("newReader begin '%d': %v", segment.seq, err)
 		}
+		rv.segments = append(rv.segments, segment)
 		rv.txs = append(rv.txs, tx)
-		mutationsBucket := tx.Bucket(mutationsBucketName)
+		source := boltSource{tx}
+		rv.sources = append(rv.sources, source)
+		mutationsBucket, deletionsBucket := source.keyspace("")
 		rv.mutations = append(rv.mutations, mutationsBucket)
-		deletionsBucket := tx.Bucket(deletionsBucketName)
 		rv.deletions = append(rv.deletions, deletionsBucket)
 	}
 
 	return rv, nil
 }
 
+// overlay places a source which is not a segment, such as the uncommitted
+// writes of a transaction, in front of everything already in the reader,
+// so that reads observe it first
+func (r *reader) overlay(source kvSource) {
+	mutations, deletions := source.keyspace(r.keyspace)
+	r.segments = append([]*segment{nil}, r.segments...)
+	r.sources = append([]kvSource{source}, r.sources...)
+	r.mutations = append([]kvBucket{mutations}, r.mutations...)
+	r.deletions = append([]kvBucket{deletions}, r.deletions...)
+}
+
+// forKeyspace returns a reader of the named keyspace of the same sources
+// it shares the bolt txs of r, and is only valid until r is closed
+func (r *reader) forKeyspace(name string) *reader {
+	rv := &reader{
+		root:      r.root,
+		keyspace:  name,
+		segments:  make([]*segment, len(r.sources)),
+		sources:   r.sources,
+		mutations: make([]kvBucket, 0, len(r.sources)),
+		deletions: make([]kvBucket, 0, len(r.sources)),
+	}
+	if name == "" {
+		copy(rv.segments, r.segments)
+	}
+	for _, source := range r.sources {
+		mutations, deletions := source.keyspace(name)
+		rv.mutations = append(rv.mutations, mutations)
+		rv.deletions = append(rv.deletions, deletions)
+	}
+	return rv
+}
+
+// keyspaceNames returns the sorted names of the named keyspaces in any of
+// the sources
+func (r *reader) keyspaceNames() []string {
+	names := make(map[string]struct{})
+	for _, source := range r.sources {
+		for _, name := range source.keyspaceNames() {
+			names[name] = struct{}{}
+		}
+	}
+	rv := make([]string, 0, len(names))
+	for name := range names {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
 func (r *reader) Get(key []byte) []byte {
 	var rv []byte
+	var hash uint64
+	var hashed bool
 	for j, mutationsBucket := range r.mutations {
+		segment := r.segments[j]
+		if segment.beforeRange(key) || segment.afterRange(key) {
+			// key outside the range of this segment
+			continue
+		}
+		if segment != nil && segment.bloom != nil {
+			if !hashed {
+				hash = bloomHash(key)
+				hashed = true
+			}
+			if !segment.bloom.mayContain(hash) {
+				// key definitely not in this segment
+				continue
+			}
+		}
 		deletionsBucket := r.deletions[j]
 		v := deletionsBucket.Get(key)
 		if v != nil {
@@ -13,10 +13,14 @@
 package cellar
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"os"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
@@ -27,16 +31,40 @@ var segmentOpts = bolt.Options{
 
 const segmentPrefix = "cellar-"
 
+// segmentTempSuffix is appended to the filename of a segment being built
+const segmentTempSuffix = ".tmp"
+
 var metaBucketName = []byte("x")
 var mutationsBucketName = []byte("m")
 var deletionsBucketName = []byte("d")
+
+// keyspacesBucketName holds a bucket for each named keyspace, which in turn
+// holds its own mutations and deletions buckets, see Tx.Keyspace
+var keyspacesBucketName = []byte("k")
 var seqKeyName = []byte("seq")
+var minKeyName = []byte("min")
+var maxKeyName = []byte("max")
+var mutationsCountKeyName = []byte("mutations")
+var deletionsCountKeyName = []byte("deletions")
+var createdKeyName = []byte("created")
 
 // Segment is a read-only bolt.DB, plus some extra bookkeeping
 type segment struct {
 	*bolt.DB
 	seq uint64
 
+	// bloom is nil if the segment was built without a bloom filter
+	bloom *bloomFilter
+	// smallest and largest key mutated/deleted, nil if not recorded
+	minKey []byte
+	maxKey []byte
+
+	size      int64
+	mutations uint64
+	deletions uint64
+	created   time.Time
+
+	// mergeInProgress is the seq of the merge output, accessed atomically
 	mergeInProgress uint64
 
 	refsCond *sync.Cond
@@ -91,14 +119,169 @@ func openSegmentPath(path string) (*segment, error) {
 			return err
 		}
 		rv.seq = segmentSeq
+		if minKey := meta.Get(minKeyName); minKey != nil {
+			rv.minKey = append([]byte(nil), minKey...)
+		}
+		if maxKey := meta.Get(maxKeyName); maxKey != nil {
+			rv.maxKey = append([]byte(nil), maxKey...)
+		}
+		bloomBytes := meta.Get(bloomKeyName)
+		if bloomBytes != nil {
+			rv.bloom, err = parseBloomFilter(bloomBytes)
+			if err != nil {
+				return err
+			}
+		}
+		mutations := meta.Get(mutationsCountKeyName)
+		deletions := meta.Get(deletionsCountKeyName)
+		if len(mutations) == 8 && len(deletions) == 8 {
+			rv.mutations = decodeUint64(mutations)
+			rv.deletions = decodeUint64(deletions)
+		} else {
+			// older segment without counts, count the hard way
+			rv.mutations = uint64(tx.Bucket(mutationsBucketName).Stats().KeyN)
+			rv.deletions = uint64(tx.Bucket(deletionsBucketName).Stats().KeyN)
+		}
+		if created := meta.Get(createdKeyName); len(created) == 8 {
+			rv.created = time.Unix(0, int64(decodeUint64(created)))
+		}
+		rv.size = tx.Size()
 		return nil
 	})
 	if err != nil {
+		_ = db.Close()
 		return nil, err
 	}
+	if rv.created.IsZero() {
+		// older segment without a created time, use the file's
+		if fileInfo, err := os.Stat(path); err == nil {
+			rv.created = fileInfo.ModTime()
+		}
+	}
 	return rv, nil
 }
 
+// segmentKeyspace returns the mutations and deletions buckets of a keyspace,
+// "" is the default keyspace, nil if the segment has no keys in it
+func segmentKeyspace(tx *bolt.Tx, name string) (mutations, deletions *bolt.Bucket) {
+	if name == "" {
+		return tx.Bucket(mutationsBucketName), tx.Bucket(deletionsBucketName)
+	}
+	keyspaces := tx.Bucket(keyspacesBucketName)
+	if keyspaces == nil {
+		return nil, nil
+	}
+	keyspace := keyspaces.Bucket([]byte(name))
+	if keyspace == nil {
+		return nil, nil
+	}
+	return keyspace.Bucket(mutationsBucketName), keyspace.Bucket(deletionsBucketName)
+}
+
+// segmentKeyspaceNames returns the sorted names of the named keyspaces in
+// the segment
+func segmentKeyspaceNames(tx *bolt.Tx) []string {
+	keyspaces := tx.Bucket(keyspacesBucketName)
+	if keyspaces == nil {
+		return nil
+	}
+	var rv []string
+	_ = keyspaces.ForEach(func(k, v []byte) error {
+		rv = append(rv, string(k))
+		return nil
+	})
+	return rv
+}
+
+// SegmentInfo is a read-only description of a segment, as seen by a
+// MergePolicy
+type SegmentInfo struct {
+	Seq uint64
+	// Size is the size of the segment file in bytes
+	Size int64
+	// Mutations and Deletions are the number of keys in each bucket,
+	// recorded when the segment was built
+	Mutations uint64
+	Deletions uint64
+	// Age is the time since the segment was built
+	Age time.Duration
+	// MinKey and MaxKey are the smallest and largest key mutated/deleted,
+	// nil if not known
+	MinKey []byte
+	MaxKey []byte
+	// MergeInProgress is true if the segment is already being merged
+	MergeInProgress bool
+}
+
+// Keys returns the total number of keys mutated or deleted in the segment
+func (s SegmentInfo) Keys() uint64 {
+	return s.Mutations + s.Deletions
+}
+
+// TombstoneRatio returns the fraction of the keys in the segment which are
+// deletes (tombstones)
+func (s SegmentInfo) TombstoneRatio() float64 {
+	if s.Keys() == 0 {
+		return 0
+	}
+	return float64(s.Deletions) / float64(s.Keys())
+}
+
+func (s *segment) info(now time.Time) SegmentInfo {
+	return SegmentInfo{
+		Seq:             s.seq,
+		Size:            s.size,
+		Mutations:       s.mutations,
+		Deletions:       s.deletions,
+		Age:             now.Sub(s.created),
+		MinKey:          s.minKey,
+		MaxKey:          s.maxKey,
+		MergeInProgress: atomic.LoadUint64(&s.mergeInProgress) != 0,
+	}
+}
+
+func encodeUint64(v uint64) []byte {
+	rv := make([]byte, 8)
+	binary.BigEndian.PutUint64(rv, v)
+	return rv
+}
+
+func decodeUint64(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+// beforeRange returns true if key is known to sort before every key in
+// this segment
+func (s *segment) beforeRange(key []byte) bool {
+	return s != nil && s.minKey != nil && bytes.Compare(key, s.minKey) < 0
+}
+
+// afterRange returns true if key is known to sort after every key in
+// this segment
+func (s *segment) afterRange(key []byte) bool {
+	return s != nil && s.maxKey != nil && bytes.Compare(key, s.maxKey) > 0
+}
+
+// overlaps returns true unless the segment is known to contain no keys in
+// the range [start, end), a nil start or end is unbounded
+func (s *segment) overlaps(start, end []byte) bool {
+	if s == nil || s.minKey == nil {
+		return true
+	}
+	return (end == nil || bytes.Compare(s.minKey, end) < 0) &&
+		(start == nil || bytes.Compare(s.maxKey, start) >= 0)
+}
+
+// within returns true if every key in the segment is known to be in the
+// range [start, end), a nil start or end is unbounded
+func (s *segment) within(start, end []byte) bool {
+	if s == nil || s.minKey == nil {
+		return false
+	}
+	return (start == nil || bytes.Compare(s.minKey, start) >= 0) &&
+		(end == nil || bytes.Compare(s.maxKey, end) < 0)
+}
+
 func (s *segment) Seq() uint64 {
 	return s.seq
 }
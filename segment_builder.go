@@ -13,23 +13,45 @@
 package cellar
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/boltdb/bolt"
 )
 
+// segmentBuilder writes a new segment under a temporary name, it is only
+// renamed to its final segment filename once Build succeeds, so that a file
+// with a valid segment filename is always complete
 type segmentBuilder struct {
+	path      string
+	tempPath  string
 	db        *bolt.DB
 	tx        *bolt.Tx
 	mutations *bolt.Bucket
 	deletions *bolt.Bucket
 	metadata  *bolt.Bucket
+	// keyspaces holds the mutations and deletions buckets of each named
+	// keyspace written so far
+	keyspaces map[string][2]*bolt.Bucket
+	options   *Options
+	// renamed is set once the segment has its final filename
+	renamed bool
+
+	// hashes of every key put/deleted, used to build the bloom filter
+	keyHashes []uint64
+	// smallest and largest key put/deleted
+	minKey []byte
+	maxKey []byte
 }
 
-func newSegmentBuilder(cellarPath string, seq uint64) (*segmentBuilder, error) {
-	path := fmt.Sprintf("%s/%s%016x", cellarPath, segmentPrefix, seq)
-	db, err := bolt.Open(path, 0600, nil)
+func newSegmentBuilder(cellarPath string, seq uint64, options *Options) (*segmentBuilder, error) {
+	path := fmt.Sprintf("%s%s%s", cellarPath, string(os.PathSeparator), segmentFilename(seq))
+	tempPath := path + segmentTempSuffix
+	db, err := bolt.Open(tempPath, 0600, nil)
 	if err != nil {
 		return nil, fmt.Errorf("newSegmentBuilder Open: %v", err)
 	}
@@ -38,43 +60,83 @@ func newSegmentBuilder(cellarPath string, seq uint64) (*segmentBuilder, error) {
 	// try to start a write transaction
 	tx, err := db.Begin(true)
 	if err != nil {
+		_ = db.Close()
+		_ = os.Remove(tempPath)
 		return nil, fmt.Errorf("newSegmentBuilder Begin: %v", err)
 	}
-	mutations, err := tx.CreateBucketIfNotExists(mutationsBucketName)
+	rv := &segmentBuilder{
+		path:     path,
+		tempPath: tempPath,
+		db:       db,
+		tx:       tx,
+		options:  options,
+	}
+	err = rv.init(seq)
+	if err != nil {
+		rv.discard()
+		return nil, err
+	}
+	return rv, nil
+}
+
+func (s *segmentBuilder) init(seq uint64) error {
+	mutations, err := s.tx.CreateBucketIfNotExists(mutationsBucketName)
 	if err != nil {
-		return nil, fmt.Errorf("newSegmentBuilder CreateBucketIfNotExists '%s': %v", mutationsBucketName, err)
+		return fmt.Errorf("newSegmentBuilder CreateBucketIfNotExists '%s': %v", mutationsBucketName, err)
 	}
 	mutations.FillPercent = 1.0
-	deletions, err := tx.CreateBucketIfNotExists(deletionsBucketName)
+	deletions, err := s.tx.CreateBucketIfNotExists(deletionsBucketName)
 	if err != nil {
-		return nil, fmt.Errorf("newSegmentBuilder CreateBucketIfNotExists '%s': %v", deletionsBucketName, err)
+		return fmt.Errorf("newSegmentBuilder CreateBucketIfNotExists '%s': %v", deletionsBucketName, err)
 	}
 	deletions.FillPercent = 1.0
-	metadata, err := tx.CreateBucketIfNotExists(metaBucketName)
+	metadata, err := s.tx.CreateBucketIfNotExists(metaBucketName)
 	if err != nil {
-		return nil, fmt.Errorf("newSegmentBuilder CreateBucketIfNotExists '%s': %v", metaBucketName, err)
+		return fmt.Errorf("newSegmentBuilder CreateBucketIfNotExists '%s': %v", metaBucketName, err)
 	}
 	err = metadata.Put(seqKeyName, []byte(fmt.Sprintf("%016x", seq)))
 	if err != nil {
-		return nil, fmt.Errorf("newSegmentBuilder Put '%s': %v", seqKeyName, err)
+		return fmt.Errorf("newSegmentBuilder Put '%s': %v", seqKeyName, err)
 	}
-	return &segmentBuilder{
-		db:        db,
-		tx:        tx,
-		mutations: mutations,
-		deletions: deletions,
-		metadata:  metadata,
-	}, nil
+	s.mutations = mutations
+	s.deletions = deletions
+	s.metadata = metadata
+	return nil
 }
 
 func (s *segmentBuilder) Put(key, val []byte) error {
-	err := s.mutations.Put(key, val)
+	err := s.put(s.mutations, s.deletions, key, val)
 	if err != nil {
 		return fmt.Errorf("segmentBuilder Put: %v", err)
 	}
+	s.addKey(key)
 	return nil
 }
 
+// PutKeyspace is Put for a named keyspace
+// the bloom filter and key range of the segment only cover the default
+// keyspace, so keys of named keyspaces are not added to them
+func (s *segmentBuilder) PutKeyspace(name string, key, val []byte) error {
+	mutations, deletions, err := s.keyspace(name)
+	if err != nil {
+		return err
+	}
+	err = s.put(mutations, deletions, key, val)
+	if err != nil {
+		return fmt.Errorf("segmentBuilder PutKeyspace: %v", err)
+	}
+	return nil
+}
+
+func (s *segmentBuilder) put(mutations, deletions *bolt.Bucket, key, val []byte) error {
+	// a put supersedes any earlier delete of this key in the same segment
+	err := deletions.Delete(key)
+	if err != nil {
+		return err
+	}
+	return mutations.Put(key, val)
+}
+
 func (s *segmentBuilder) PutMetadata(key, val []byte) error {
 	err := s.metadata.Put(key, val)
 	if err != nil {
@@ -84,27 +146,183 @@ func (s *segmentBuilder) PutMetadata(key, val []byte) error {
 }
 
 func (s *segmentBuilder) Delete(key []byte) error {
-	err := s.deletions.Put(key, []byte{})
+	err := s.delete(s.mutations, s.deletions, key)
 	if err != nil {
 		return fmt.Errorf("segmentBuilder Delete: %v", err)
 	}
+	s.addKey(key)
+	return nil
+}
+
+// DeleteKeyspace is Delete for a named keyspace
+func (s *segmentBuilder) DeleteKeyspace(name string, key []byte) error {
+	mutations, deletions, err := s.keyspace(name)
+	if err != nil {
+		return err
+	}
+	err = s.delete(mutations, deletions, key)
+	if err != nil {
+		return fmt.Errorf("segmentBuilder DeleteKeyspace: %v", err)
+	}
 	return nil
 }
 
+func (s *segmentBuilder) delete(mutations, deletions *bolt.Bucket, key []byte) error {
+	// a delete supersedes any earlier put of this key in the same segment
+	err := mutations.Delete(key)
+	if err != nil {
+		return err
+	}
+	return deletions.Put(key, []byte{})
+}
+
+// keyspace returns the buckets of a named keyspace, creating them if needed
+func (s *segmentBuilder) keyspace(name string) (mutations, deletions *bolt.Bucket, err error) {
+	if buckets, ok := s.keyspaces[name]; ok {
+		return buckets[0], buckets[1], nil
+	}
+	keyspaces, err := s.tx.CreateBucketIfNotExists(keyspacesBucketName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("segmentBuilder CreateBucketIfNotExists '%s': %v", keyspacesBucketName, err)
+	}
+	keyspace, err := keyspaces.CreateBucketIfNotExists([]byte(name))
+	if err != nil {
+		return nil, nil, fmt.Errorf("segmentBuilder CreateBucketIfNotExists keyspace '%s': %v", name, err)
+	}
+	mutations, err = keyspace.CreateBucketIfNotExists(mutationsBucketName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("segmentBuilder CreateBucketIfNotExists '%s': %v", mutationsBucketName, err)
+	}
+	mutations.FillPercent = 1.0
+	deletions, err = keyspace.CreateBucketIfNotExists(deletionsBucketName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("segmentBuilder CreateBucketIfNotExists '%s': %v", deletionsBucketName, err)
+	}
+	deletions.FillPercent = 1.0
+	if s.keyspaces == nil {
+		s.keyspaces = make(map[string][2]*bolt.Bucket)
+	}
+	s.keyspaces[name] = [2]*bolt.Bucket{mutations, deletions}
+	return mutations, deletions, nil
+}
+
+// source returns the uncommitted writes as a kvSource, named keyspaces
+// are created as they are read, so that later writes to them are seen
+func (s *segmentBuilder) source() kvSource {
+	return builderSource{s}
+}
+
+type builderSource struct {
+	builder *segmentBuilder
+}
+
+func (s builderSource) keyspace(name string) (mutations, deletions kvBucket) {
+	if name == "" {
+		return boltBucket{s.builder.mutations}, boltBucket{s.builder.deletions}
+	}
+	mutationsBucket, deletionsBucket, err := s.builder.keyspace(name)
+	if err != nil {
+		return memBucket(nil), memBucket(nil)
+	}
+	return boltBucket{mutationsBucket}, boltBucket{deletionsBucket}
+}
+
+func (s builderSource) keyspaceNames() []string {
+	return segmentKeyspaceNames(s.builder.tx)
+}
+
+func (s *segmentBuilder) addKey(key []byte) {
+	if s.options.BloomFalsePositiveRate > 0 {
+		s.keyHashes = append(s.keyHashes, bloomHash(key))
+	}
+	if s.minKey == nil || bytes.Compare(key, s.minKey) < 0 {
+		s.minKey = append([]byte(nil), key...)
+	}
+	if s.maxKey == nil || bytes.Compare(key, s.maxKey) > 0 {
+		s.maxKey = append([]byte(nil), key...)
+	}
+}
+
 func (s *segmentBuilder) Build() error {
-	err := s.tx.Commit()
+	if s.options.BloomFalsePositiveRate > 0 {
+		filter := newBloomFilter(len(s.keyHashes), s.options.BloomFalsePositiveRate)
+		for _, hash := range s.keyHashes {
+			filter.add(hash)
+		}
+		filterBytes, err := filter.MarshalBinary()
+		if err != nil {
+			return fmt.Errorf("segmentBuilder Build bloom: %v", err)
+		}
+		err = s.PutMetadata(bloomKeyName, filterBytes)
+		if err != nil {
+			return err
+		}
+	}
+	checksum, mutations, deletions, err := segmentChecksum(s.tx)
+	if err != nil {
+		return fmt.Errorf("segmentBuilder Build checksum: %v", err)
+	}
+	checksumBytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(checksumBytes, checksum)
+	err = s.PutMetadata(checksumKeyName, checksumBytes)
+	if err != nil {
+		return err
+	}
+	err = s.PutMetadata(mutationsCountKeyName, encodeUint64(mutations))
+	if err != nil {
+		return err
+	}
+	err = s.PutMetadata(deletionsCountKeyName, encodeUint64(deletions))
+	if err != nil {
+		return err
+	}
+	err = s.PutMetadata(createdKeyName, encodeUint64(uint64(time.Now().UnixNano())))
+	if err != nil {
+		return err
+	}
+	if s.minKey != nil {
+		err := s.PutMetadata(minKeyName, s.minKey)
+		if err != nil {
+			return err
+		}
+		err = s.PutMetadata(maxKeyName, s.maxKey)
+		if err != nil {
+			return err
+		}
+	}
+	err = s.tx.Commit()
 	if err != nil {
 		return fmt.Errorf("segmentBuilder Build Commit: %v", err)
 	}
+	// we opened with no-sync, so sync once now that the segment is complete
+	if s.options.Durability != DurabilityNone {
+		err = s.db.Sync()
+		if err != nil {
+			return fmt.Errorf("segmentBuilder Build Sync: %v", err)
+		}
+	}
 	err = s.db.Close()
 	if err != nil {
 		return fmt.Errorf("segmentBuilder Build Close: %v", err)
 	}
+	// the segment is complete, give it the real name
+	err = os.Rename(s.tempPath, s.path)
+	if err != nil {
+		return fmt.Errorf("segmentBuilder Build Rename: %v", err)
+	}
+	s.renamed = true
+	// the root may record this segment as soon as we return, so make the
+	// new name durable first
+	if s.options.Durability != DurabilityNone {
+		err = syncDir(filepath.Dir(s.path))
+		if err != nil {
+			return fmt.Errorf("segmentBuilder Build syncDir: %v", err)
+		}
+	}
 	return nil
 }
 
 func (s *segmentBuilder) Abort() error {
-	cleanupPath := s.db.Path()
 	err := s.tx.Rollback()
 	if err != nil {
 		return fmt.Errorf("segmentBuilder Abort Rollback: %v", err)
@@ -113,9 +331,36 @@ func (s *segmentBuilder) Abort() error {
 	if err != nil {
 		return fmt.Errorf("segmentBuilder Abort Close: %v", err)
 	}
-	err = os.Remove(cleanupPath)
+	err = os.Remove(s.tempPath)
 	if err != nil {
 		return fmt.Errorf("segmentBuilder Abort Remove: %v", err)
 	}
 	return nil
 }
+
+// discard abandons the segment, removing any file written for it
+// unlike Abort, it is safe to call at any point, including after Build
+// failed part way through, errors are ignored as there is nothing more to do
+func (s *segmentBuilder) discard() {
+	// rollback first, close waits for the write tx to finish
+	_ = s.tx.Rollback()
+	_ = s.db.Close()
+	_ = os.Remove(s.tempPath)
+	if s.renamed {
+		_ = os.Remove(s.path)
+	}
+}
+
+// syncDir syncs a directory, making the entries within it durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	cerr := dir.Close()
+	if err != nil {
+		return err
+	}
+	return cerr
+}
@@ -16,6 +16,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"io"
+	"time"
 )
 
 type segmentList []*segment
@@ -31,6 +32,34 @@ func (s segmentList) MarshalBinary() (data []byte, err error) {
 	return buf.Bytes(), nil
 }
 
+// infos returns a SegmentInfo for each segment, in the same order
+func (s segmentList) infos() []SegmentInfo {
+	now := time.Now()
+	rv := make([]SegmentInfo, len(s))
+	for i, segment := range s {
+		rv[i] = segment.info(now)
+	}
+	return rv
+}
+
+// overlapping returns the shortest run of adjacent segments which includes
+// every segment that may contain keys in the range [start, end)
+func (s segmentList) overlapping(start, end []byte) segmentList {
+	first, last := -1, -1
+	for i, segment := range s {
+		if segment.overlaps(start, end) {
+			if first < 0 {
+				first = i
+			}
+			last = i
+		}
+	}
+	if first < 0 {
+		return nil
+	}
+	return s[first : last+1]
+}
+
 func parseRoot(val []byte) ([]uint64, error) {
 	var rv []uint64
 	buf := bytes.NewBuffer(val)
@@ -12,8 +12,36 @@
 
 package cellar
 
+import "time"
+
 // Stats returns interesting values about performance/behavior of the cellar
 type Stats struct {
 	segments        uint64
 	mergesCompleted uint64
+	// mergeThrottled is the nanoseconds merges spent sleeping to stay
+	// within the merge rate limits
+	mergeThrottled uint64
+	mergesFailed   uint64
+}
+
+// Segments returns the number of segments on the root
+func (s *Stats) Segments() uint64 {
+	return s.segments
+}
+
+// MergesCompleted returns the number of merges made live
+func (s *Stats) MergesCompleted() uint64 {
+	return s.mergesCompleted
+}
+
+// MergesFailed returns the number of background merges which have failed,
+// each attempt of a retried merge is counted
+func (s *Stats) MergesFailed() uint64 {
+	return s.mergesFailed
+}
+
+// MergeThrottled returns the total time merges have spent sleeping to stay
+// within Options.MergeWriteRate and Options.MergeReadRate
+func (s *Stats) MergeThrottled() time.Duration {
+	return time.Duration(s.mergeThrottled)
 }
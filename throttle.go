@@ -0,0 +1,94 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// minThrottleSleep is the smallest delay a rateLimiter sleeps for, smaller
+// delays are carried over until they add up, to avoid sleeping per key
+const minThrottleSleep = 10 * time.Millisecond
+
+// rateLimiter limits the number of bytes per second passing through it
+// the rate can be changed at any time, a rate <= 0 is unlimited
+type rateLimiter struct {
+	rate int64 // atomic
+
+	mutex sync.Mutex
+	// next is the time by which all the bytes let through are paid for
+	next time.Time
+}
+
+func (r *rateLimiter) setRate(rate int64) {
+	atomic.StoreInt64(&r.rate, rate)
+}
+
+// wait lets n bytes through, sleeping if they exceed the rate, until one of
+// cancel, closed or done is closed
+// it returns the time spent sleeping
+func (r *rateLimiter) wait(n int, cancel, closed, done <-chan struct{}) time.Duration {
+	rate := atomic.LoadInt64(&r.rate)
+	if rate <= 0 || n <= 0 {
+		return 0
+	}
+	r.mutex.Lock()
+	now := time.Now()
+	if r.next.Before(now) {
+		// idle time does not build up credit
+		r.next = now
+	}
+	r.next = r.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	delay := r.next.Sub(now)
+	r.mutex.Unlock()
+	if delay < minThrottleSleep {
+		return 0
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return delay
+	case <-cancel:
+	case <-closed:
+	case <-done:
+	}
+	return time.Since(now)
+}
+
+// SetMergeWriteRate changes the limit on bytes per second written by merges,
+// see Options.MergeWriteRate
+func (c *Cellar) SetMergeWriteRate(rate int64) {
+	c.mergeWriteLimiter.setRate(rate)
+}
+
+// SetMergeReadRate changes the limit on bytes per second read by merges,
+// see Options.MergeReadRate
+func (c *Cellar) SetMergeReadRate(rate int64) {
+	c.mergeReadLimiter.setRate(rate)
+}
+
+// throttleMerge is called as a merge reads and writes bytes, it sleeps as
+// needed to enforce the merge rate limits, unless the merge is canceled, its
+// context done or the cellar closed
+func (c *Cellar) throttleMerge(m *Merge, read, written int) {
+	closed := c.mergeManager.closeChan
+	done := m.done()
+	throttled := c.mergeReadLimiter.wait(read, m.cancel, closed, done) +
+		c.mergeWriteLimiter.wait(written, m.cancel, closed, done)
+	if throttled > 0 {
+		atomic.AddUint64(&c.stats.mergeThrottled, uint64(throttled))
+	}
+}
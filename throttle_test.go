@@ -0,0 +1,147 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var r rateLimiter
+
+	// unlimited
+	for i := 0; i < 1000; i++ {
+		if r.wait(1024, nil, nil, nil) != 0 {
+			t.Fatalf("expected no throttling without a rate")
+		}
+	}
+
+	// 100KB/s, so 20KB should take about 200ms
+	r.setRate(100 * 1024)
+	start := time.Now()
+	var throttled time.Duration
+	for i := 0; i < 20; i++ {
+		throttled += r.wait(1024, nil, nil, nil)
+	}
+	elapsed := time.Since(start)
+	if elapsed < 150*time.Millisecond {
+		t.Errorf("expected at least 150ms, took %v", elapsed)
+	}
+	if throttled <= 0 || throttled > elapsed {
+		t.Errorf("expected throttled time in (0, %v], got %v", elapsed, throttled)
+	}
+
+	// lifting the limit takes effect immediately
+	r.setRate(0)
+	if r.wait(1024*1024, nil, nil, nil) != 0 {
+		t.Errorf("expected no throttling after removing the rate")
+	}
+}
+
+func TestCellarMergeThrottled(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	options := *testOptionsNoAutoMerge
+	options.MergeWriteRate = 1
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := 0; i < 4; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// changing the rate at runtime replaces the one from Options
+	c.SetMergeWriteRate(64 * 1024)
+	err = c.Compact(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Stats().MergeThrottled() <= 0 {
+		t.Errorf("expected merge to be throttled")
+	}
+
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k000000000000018f", "v000000000000018f", 400)
+		return nil
+	})
+}
+
+func TestCellarMergeThrottledInterrupted(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	// 1 byte per second, each key would hold up the merge for many seconds
+	options := *testOptionsNoAutoMerge
+	options.MergeWriteRate = 1
+	c, err := Open("test", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	compact := func() chan error {
+		rv := make(chan error, 1)
+		go func() {
+			rv <- c.Compact(context.Background())
+		}()
+		// let the merge start sleeping
+		time.Sleep(100 * time.Millisecond)
+		return rv
+	}
+
+	errs := compact()
+	c.CancelMerges()
+	select {
+	case err = <-errs:
+		if err != ErrMergeCanceled {
+			t.Errorf("expected ErrMergeCanceled, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected CancelMerges to interrupt the throttled merge")
+	}
+
+	errs = compact()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.Close()
+	}()
+	select {
+	case err = <-closed:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Close to interrupt the throttled merge")
+	}
+	if err = <-errs; err == nil {
+		t.Errorf("expected the merge interrupted by Close to fail")
+	}
+}
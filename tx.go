@@ -12,14 +12,27 @@
 
 package cellar
 
+import "os"
+
 // Tx represents a cellar transaction
 type Tx struct {
 	cellar         *Cellar
 	writable       bool
 	managed        bool
 	segmentBuilder *segmentBuilder
-	root           segmentList
-	reader         *reader
+	// buffer holds the writes instead of segmentBuilder when the memtable
+	// is enabled
+	buffer *memBuffer
+	root   segmentList
+	reader *reader
+
+	// for writable transactions, the commitSeq this one began after, and
+	// the keys it has read, see conflict.go
+	beginSeq uint64
+	reads    *readSet
+
+	// keyspaces are the named keyspaces used so far, see Keyspace
+	keyspaces map[string]*Keyspace
 }
 
 // Rollback will abort this transaction, none of the operations performed
@@ -38,7 +51,7 @@ func (tx *Tx) rollback() error {
 	if tx.cellar == nil {
 		return nil
 	}
-	if tx.writable {
+	if tx.segmentBuilder != nil {
 		err := tx.segmentBuilder.Abort()
 		if err != nil {
 			return err
@@ -52,7 +65,9 @@ func (tx *Tx) close() error {
 		return nil
 	}
 	if tx.writable {
-		tx.cellar.rwlock.Unlock()
+		tx.cellar.commitLock.Lock()
+		tx.cellar.endWriterLocked(tx)
+		tx.cellar.commitLock.Unlock()
 	}
 	if tx.root != nil {
 		for _, segment := range tx.root {
@@ -83,19 +98,73 @@ func (tx *Tx) Commit() error {
 	} else if !tx.writable {
 		return ErrTxNotWritable
 	}
-	// build the new segment
-	newSegmentPath := tx.segmentBuilder.db.Path()
+	if tx.buffer != nil {
+		return tx.commitMemtable()
+	}
+	// build the new segment, from here on a failed commit can't be rolled
+	// back, so it removes the segment and closes the tx itself
+	newSegmentPath := tx.segmentBuilder.path
 	err := tx.segmentBuilder.Build()
 	if err != nil {
+		tx.segmentBuilder.discard()
+		_ = tx.close()
 		return err
 	}
 	newsegment, err := openSegmentPath(newSegmentPath)
 	if err != nil {
+		_ = os.Remove(newSegmentPath)
+		_ = tx.close()
 		return err
 	}
-	// make this segment live
-	err = tx.cellar.pushRoot(newsegment)
+	// make this segment live, unless it conflicts with commits since Begin
+	c := tx.cellar
+	c.commitLock.Lock()
+	written, err := c.validateLocked(tx, func() (keyspaceKeys, error) {
+		return segmentKeys(newsegment)
+	})
+	if err == nil {
+		err = c.pushRoot(newsegment)
+	}
+	if err == nil {
+		c.commitSeq++
+		if written != nil {
+			c.commits = append(c.commits, commitRecord{seq: c.commitSeq, keys: written})
+		}
+	}
+	c.commitLock.Unlock()
 	if err != nil {
+		// this segment will never be live
+		removeSegments(segmentList{newsegment})
+		_ = tx.close()
+		return err
+	}
+	return tx.close()
+}
+
+// commitMemtable commits the buffered writes as a run on the memtable
+func (tx *Tx) commitMemtable() error {
+	run := tx.buffer.commitRun()
+	c := tx.cellar
+	c.commitLock.Lock()
+	written, err := c.validateLocked(tx, func() (keyspaceKeys, error) {
+		return run.keys(), nil
+	})
+	if err == nil && !run.empty() {
+		// the commit is only acknowledged once it is in the log
+		err = c.wal.append(run)
+	}
+	if err == nil {
+		err = c.pushMemRunLocked(run)
+	}
+	if err == nil {
+		c.commitSeq++
+		if written != nil {
+			c.commits = append(c.commits, commitRecord{seq: c.commitSeq, keys: written})
+		}
+	}
+	c.commitLock.Unlock()
+	if err != nil {
+		_ = tx.close()
 		return err
 	}
 	return tx.close()
@@ -103,14 +172,23 @@ func (tx *Tx) Commit() error {
 
 // Get will look up the specified key
 // if theere is no value, nil is returned
+// in a writable transaction, uncommitted Put/Delete operations are visible
 // NOTE: an empty byte slice is a valid value, and not the same as nil
 func (tx *Tx) Get(key []byte) []byte {
+	if tx.reads != nil {
+		tx.reads.addKey(key)
+	}
 	return tx.reader.Get(key)
 }
 
 // Cursor returns an object which can be used to iterate k/v paris in the cellar
+// in a writable transaction, uncommitted Put/Delete operations are visible
+// NOTE: like bolt, modifying the transaction while iterating may invalidate
+// the cursor
 func (tx *Tx) Cursor() *Cursor {
-	return newCursor(tx.reader)
+	rv := newCursor(tx.reader)
+	rv.reads = tx.reads
+	return rv
 }
 
 // Delete will remove the key from the cellar
@@ -120,6 +198,9 @@ func (tx *Tx) Delete(key []byte) error {
 	} else if !tx.writable {
 		return ErrTxNotWritable
 	}
+	if tx.buffer != nil {
+		return tx.buffer.Delete(key)
+	}
 	return tx.segmentBuilder.Delete(key)
 }
 
@@ -130,5 +211,8 @@ func (tx *Tx) Put(key []byte, value []byte) error {
 	} else if !tx.writable {
 		return ErrTxNotWritable
 	}
+	if tx.buffer != nil {
+		return tx.buffer.Put(key, value)
+	}
 	return tx.segmentBuilder.Put(key, value)
 }
@@ -15,7 +15,9 @@ package cellar
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
 )
 
 func TestTxInvalidState(t *testing.T) {
@@ -136,3 +138,422 @@ func TestTxRollback(t *testing.T) {
 	}
 
 }
+
+func TestTxReadYourOwnWrites(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// create the first segment
+	err = c.Update(func(tx *Tx) error {
+		putKvPairs(tx, 0, 100)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = c.Update(func(tx *Tx) error {
+		// new key, visible before commit
+		err := tx.Put([]byte("k0000000000000064"), []byte("v0000000000000064"))
+		if err != nil {
+			return err
+		}
+		checkKey(t, tx, "k0000000000000064", "v0000000000000064")
+
+		// overwrite a committed key
+		err = tx.Put([]byte("k0000000000000001"), []byte("v000000000000000x"))
+		if err != nil {
+			return err
+		}
+		checkKey(t, tx, "k0000000000000001", "v000000000000000x")
+
+		// delete a committed key
+		err = tx.Delete([]byte("k0000000000000000"))
+		if err != nil {
+			return err
+		}
+		checkNoKey(t, tx, "k0000000000000000")
+
+		// put then delete within the same tx
+		err = tx.Put([]byte("k0000000000000065"), []byte("v0000000000000065"))
+		if err != nil {
+			return err
+		}
+		err = tx.Delete([]byte("k0000000000000065"))
+		if err != nil {
+			return err
+		}
+		checkNoKey(t, tx, "k0000000000000065")
+
+		// delete then put within the same tx
+		err = tx.Delete([]byte("k0000000000000002"))
+		if err != nil {
+			return err
+		}
+		err = tx.Put([]byte("k0000000000000002"), []byte("v000000000000000y"))
+		if err != nil {
+			return err
+		}
+		checkKey(t, tx, "k0000000000000002", "v000000000000000y")
+
+		checkCursor(t, tx, "k0000000000000001", "v000000000000000x", "k0000000000000064", "v0000000000000064", 100)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// same view after commit
+	c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, "k0000000000000000")
+		checkNoKey(t, tx, "k0000000000000065")
+		checkKey(t, tx, "k0000000000000001", "v000000000000000x")
+		checkKey(t, tx, "k0000000000000002", "v000000000000000y")
+		checkCursor(t, tx, "k0000000000000001", "v000000000000000x", "k0000000000000064", "v0000000000000064", 100)
+		return nil
+	})
+
+	// writes from a rolled back tx were only ever visible to that tx
+	tx, err := c.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Put([]byte("k0000000000000066"), []byte("v0000000000000066"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKey(t, tx, "k0000000000000066", "v0000000000000066")
+	err = tx.Rollback()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, "k0000000000000066")
+		return nil
+	})
+}
+
+func TestTxSegmentTempFile(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	tx, err := c.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putKvPairs(tx, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// while building, only the temp file exists
+	if _, err := os.Stat("test/cellar-0000000000000001.tmp"); os.IsNotExist(err) {
+		t.Errorf("expected cellar temp file 'test/cellar-0000000000000001.tmp' to exist, missing")
+	}
+	if _, err := os.Stat("test/cellar-0000000000000001"); err == nil {
+		t.Errorf("expected cellar segment file 'test/cellar-0000000000000001' to be missing, it exists")
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// after commit, only the segment file exists
+	if _, err := os.Stat("test/cellar-0000000000000001"); os.IsNotExist(err) {
+		t.Errorf("expected cellar segment file 'test/cellar-0000000000000001' to exist, missing")
+	}
+	if _, err := os.Stat("test/cellar-0000000000000001.tmp"); err == nil {
+		t.Errorf("expected cellar temp file 'test/cellar-0000000000000001.tmp' to be missing, it exists")
+	}
+}
+
+func TestTxConcurrentWriters(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// both are open at once, writing different keys
+	tx1, err := c.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx2, err := c.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putKvPairs(tx1, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = putKvPairs(tx2, 10, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx2.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx1.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.View(func(tx *Tx) error {
+		checkCursor(t, tx, "k0000000000000000", "v0000000000000000", "k0000000000000013", "v0000000000000013", 20)
+		return nil
+	})
+	if len(c.commits) != 0 {
+		t.Errorf("expected no commits kept once all writers are done, got %d", len(c.commits))
+	}
+}
+
+func TestTxConflict(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 0, 100)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		tx       func(tx *Tx) error
+		conflict bool
+	}{
+		{
+			name: "write same key",
+			tx: func(tx *Tx) error {
+				return tx.Put([]byte("k0000000000000005"), []byte("other"))
+			},
+			conflict: true,
+		},
+		{
+			name: "delete same key",
+			tx: func(tx *Tx) error {
+				return tx.Delete([]byte("k0000000000000005"))
+			},
+			conflict: true,
+		},
+		{
+			name: "read same key",
+			tx: func(tx *Tx) error {
+				tx.Get([]byte("k0000000000000005"))
+				return tx.Put([]byte("x"), []byte("x"))
+			},
+			conflict: true,
+		},
+		{
+			name: "scan over key",
+			tx: func(tx *Tx) error {
+				cursor := tx.Cursor()
+				k, _ := cursor.Seek([]byte("k0000000000000001"))
+				for i := 0; i < 10 && k != nil; i++ {
+					k, _ = cursor.Next()
+				}
+				return tx.Put([]byte("x"), []byte("x"))
+			},
+			conflict: true,
+		},
+		{
+			name: "scan before key",
+			tx: func(tx *Tx) error {
+				cursor := tx.Cursor()
+				k, _ := cursor.First()
+				for i := 0; i < 3 && k != nil; i++ {
+					k, _ = cursor.Next()
+				}
+				return tx.Put([]byte("x"), []byte("x"))
+			},
+		},
+		{
+			name: "different keys",
+			tx: func(tx *Tx) error {
+				tx.Get([]byte("k0000000000000006"))
+				return tx.Put([]byte("k0000000000000007"), []byte("other"))
+			},
+		},
+	}
+
+	for _, test := range tests {
+		tx, err := c.Begin(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = test.tx(tx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// meanwhile, another transaction changes k0000000000000005
+		err = c.Update(func(tx *Tx) error {
+			return tx.Put([]byte("k0000000000000005"), []byte(test.name))
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		err = tx.Commit()
+		if test.conflict && err != ErrTxConflict {
+			t.Errorf("%s: expected ErrTxConflict, got %v", test.name, err)
+		} else if !test.conflict && err != nil {
+			t.Errorf("%s: expected no conflict, got %v", test.name, err)
+		}
+		if test.conflict {
+			// the transaction is over, and its segment is gone
+			err = tx.Rollback()
+			if err != ErrTxClosed {
+				t.Errorf("%s: expected ErrTxClosed after conflict, got %v", test.name, err)
+			}
+			_, err = os.Stat(tx.segmentBuilder.path)
+			if !os.IsNotExist(err) {
+				t.Errorf("%s: expected conflicting segment to be removed, got %v", test.name, err)
+			}
+		}
+
+		c.View(func(tx *Tx) error {
+			checkKey(t, tx, "k0000000000000005", test.name)
+			return nil
+		})
+	}
+}
+
+func TestTxConflictUpdate(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	// Update returns the conflict as is, so it can be retried
+	attempts := 0
+	for {
+		attempts++
+		err = c.Update(func(tx *Tx) error {
+			tx.Get([]byte("a"))
+			if attempts == 1 {
+				// another writer changes a, while this one is running
+				err := c.Update(func(tx *Tx) error {
+					return tx.Put([]byte("a"), []byte("other"))
+				})
+				if err != nil {
+					return err
+				}
+			}
+			return tx.Put([]byte("b"), []byte("b"))
+		})
+		if err != ErrTxConflict {
+			break
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %d", attempts)
+	}
+
+	// a transaction which began after a commit does not conflict with it
+	tx, err := c.Begin(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkKey(t, tx, "a", "other")
+	err = tx.Put([]byte("a"), []byte("tx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestTxCommitFailure fails a commit after its segment is built, by closing
+// the cellar under it, the tx must still be cleaned up so Close can finish
+func TestTxCommitFailure(t *testing.T) {
+	tests := []struct {
+		name    string
+		options *Options
+	}{
+		{"segments", testOptionsNoAutoMerge},
+		{"memtable", memtableOptions(1<<30, time.Hour)},
+	}
+	for _, test := range tests {
+		func() {
+			defer os.RemoveAll("test")
+
+			c, err := Open("test", test.options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tx, err := c.Begin(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = putKvPairs(tx, 0, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			closed := make(chan error, 1)
+			go func() {
+				closed <- c.Close()
+			}()
+			for {
+				c.rootLock.RLock()
+				master := c.master
+				c.rootLock.RUnlock()
+				if master == nil {
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			err = tx.Commit()
+			if err == nil {
+				t.Fatalf("%s: expected commit to a closed cellar to fail", test.name)
+			}
+			err = tx.Rollback()
+			if err != ErrTxClosed {
+				t.Errorf("%s: expected failed commit to close the tx, got %v", test.name, err)
+			}
+			select {
+			case err = <-closed:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("%s: expected Close to finish once the commit failed", test.name)
+			}
+			segments, err := filepath.Glob(filepath.Join("test", segmentPrefix+"*"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) != 0 {
+				t.Errorf("%s: expected failed commit's segment to be removed, found %v", test.name, segments)
+			}
+		}()
+	}
+}
@@ -0,0 +1,458 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strconv"
+	"strings"
+
+	"github.com/boltdb/bolt"
+)
+
+var checksumKeyName = []byte("checksum")
+
+var checksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// segmentChecksum computes a CRC over the ordered k/v stream of the
+// mutations and deletions buckets, counting the keys in each along the way
+// the buckets of named keyspaces follow, in name order, each preceded by
+// its name
+func segmentChecksum(tx *bolt.Tx) (checksum uint32, mutations uint64, deletions uint64, err error) {
+	crc := crc32.New(checksumTable)
+	for _, name := range append([]string{""}, segmentKeyspaceNames(tx)...) {
+		if name != "" {
+			_, _ = crc.Write([]byte(name))
+		}
+		mutationsBucket, deletionsBucket := segmentKeyspace(tx, name)
+		buckets := []*bolt.Bucket{mutationsBucket, deletionsBucket}
+		counts := []*uint64{&mutations, &deletions}
+		for i, bucketName := range [][]byte{mutationsBucketName, deletionsBucketName} {
+			if buckets[i] == nil && name == "" {
+				return 0, 0, 0, fmt.Errorf("missing bucket '%s'", bucketName)
+			} else if buckets[i] == nil {
+				return 0, 0, 0, fmt.Errorf("missing bucket '%s' in keyspace '%s'", bucketName, name)
+			}
+			_, _ = crc.Write(bucketName)
+			err = checksumBucket(crc, buckets[i], counts[i])
+			if err != nil {
+				return 0, 0, 0, err
+			}
+		}
+	}
+	return crc.Sum32(), mutations, deletions, nil
+}
+
+func checksumBucket(crc hash.Hash32, bucket *bolt.Bucket, count *uint64) error {
+	var lenBuf [binary.MaxVarintLen64]byte
+	return bucket.ForEach(func(k, v []byte) error {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(k)))
+		_, _ = crc.Write(lenBuf[:n])
+		_, _ = crc.Write(k)
+		n = binary.PutUvarint(lenBuf[:], uint64(len(v)))
+		_, _ = crc.Write(lenBuf[:n])
+		_, _ = crc.Write(v)
+		*count++
+		return nil
+	})
+}
+
+// CorruptSegment describes a segment which failed verification
+type CorruptSegment struct {
+	Path string
+	Err  error
+}
+
+// VerifyError is returned by Verify when one or more segments are corrupt
+type VerifyError struct {
+	Corrupt []CorruptSegment
+}
+
+func (e *VerifyError) Error() string {
+	problems := make([]string, 0, len(e.Corrupt))
+	for _, corrupt := range e.Corrupt {
+		problems = append(problems, fmt.Sprintf("%s: %v", corrupt.Path, corrupt.Err))
+	}
+	return fmt.Sprintf("%d corrupt segment(s): %s", len(e.Corrupt), strings.Join(problems, "; "))
+}
+
+// Verify re-reads every segment on the root, checking its bolt consistency,
+// its checksum and that its seq matches its filename
+// if any segment is corrupt, a *VerifyError describing all of them is returned
+// segments built before checksums were recorded only get the other checks
+func (c *Cellar) Verify(ctx context.Context) error {
+	root := c.getRoot("cellar verify")
+	defer func() {
+		for _, segment := range root {
+			segment.decrRef("cellar verify done")
+		}
+	}()
+
+	var corrupt []CorruptSegment
+	for _, segment := range root {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// check the pages before bolt walks them in verifySegment
+		err := checkSegmentPages(segment.Path())
+		if err == nil {
+			err = verifySegment(segment.DB)
+		}
+		if err != nil {
+			corrupt = append(corrupt, CorruptSegment{Path: segment.Path(), Err: err})
+		}
+	}
+	if corrupt != nil {
+		return &VerifyError{Corrupt: corrupt}
+	}
+	return nil
+}
+
+// VerifySegment performs the same checks as Verify on a single segment file
+// it only opens the file read-only, so is safe to use on a cellar which is
+// open in another process
+func VerifySegment(path string) (err error) {
+	err = checkSegmentPages(path)
+	if err != nil {
+		return err
+	}
+	db, err := openSegmentChecked(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := db.Close()
+		if cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	return verifySegment(db)
+}
+
+// openSegmentChecked opens the bolt file at path, reporting a panic while
+// bolt reads its meta and freelist pages as corruption
+func openSegmentChecked(path string) (db *bolt.DB, err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverCorrupt(&err)
+	return bolt.Open(path, 0600, &segmentOpts)
+}
+
+// recoverCorrupt turns a panic from bolt reading a corrupt page into *err,
+// with faults turned into panics this includes reads past its mmap
+func recoverCorrupt(err *error) {
+	if r := recover(); r != nil {
+		*err = fmt.Errorf("corrupt bolt page: %v", r)
+	}
+}
+
+func verifySegment(db *bolt.DB) (err error) {
+	defer debug.SetPanicOnFault(debug.SetPanicOnFault(true))
+	defer recoverCorrupt(&err)
+	return db.View(func(tx *bolt.Tx) error {
+		// drain all errors, the check runs concurrently with this tx
+		var checkErr error
+		for err := range tx.Check() {
+			// report the first consistency problem, the rest are likely related
+			if checkErr == nil {
+				checkErr = fmt.Errorf("bolt check: %v", err)
+			}
+		}
+		if checkErr != nil {
+			return checkErr
+		}
+
+		meta := tx.Bucket(metaBucketName)
+		if meta == nil {
+			return fmt.Errorf("missing bucket '%s'", metaBucketName)
+		}
+		seq, err := strconv.ParseUint(string(meta.Get(seqKeyName)), 16, 64)
+		if err != nil {
+			return fmt.Errorf("parsing seq: %v", err)
+		}
+		if filepath.Base(db.Path()) != segmentFilename(seq) {
+			return fmt.Errorf("seq %d does not match filename", seq)
+		}
+
+		expected := meta.Get(checksumKeyName)
+		if expected == nil {
+			return nil
+		}
+		if len(expected) != 4 {
+			return fmt.Errorf("invalid checksum length %d", len(expected))
+		}
+		actual, _, _, err := segmentChecksum(tx)
+		if err != nil {
+			return fmt.Errorf("computing checksum: %v", err)
+		}
+		if actual != binary.BigEndian.Uint32(expected) {
+			return fmt.Errorf("checksum mismatch, expected %08x, got %08x", binary.BigEndian.Uint32(expected), actual)
+		}
+		return nil
+	})
+}
+
+// boltByteOrder is the byte order of bolt's on disk format, bolt writes its
+// pages in the native byte order of the machine
+var boltByteOrder = binary.NativeEndian
+
+// bolt's on disk format, as of bolt 1.3.1
+const (
+	boltMagic            = 0xED0CDAED
+	boltVersion          = 2
+	boltPageHeaderSize   = 16
+	boltElementSize      = 16
+	boltBucketHeaderSize = 16
+	boltMetaChecksumOff  = 56
+	boltMetaSize         = 64
+
+	boltBranchPageFlag   = 0x01
+	boltLeafPageFlag     = 0x02
+	boltFreelistPageFlag = 0x10
+	boltBucketLeafFlag   = 0x01
+)
+
+// pageWalker reads the pages of a bolt file, refusing any outside of it
+type pageWalker struct {
+	file     *os.File
+	size     uint64
+	pageSize uint64
+	// pgid is the high water mark of the meta in use
+	pgid    uint64
+	visited map[uint64]bool
+}
+
+// checkSegmentPages walks the bolt pages of a segment file, checking that
+// every page reachable from the meta bolt will use, and every key, value and
+// nested bucket on them, lies within the file, and that no page is reached
+// twice.  bolt trusts these offsets, so a corrupt file can make it read past
+// its mmap and crash, or loop forever, before its own Check reports anything
+// the reads of verifySegment are guarded, but Check walks the pages in a
+// goroutine of its own, where a panic cannot be recovered
+func checkSegmentPages(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	w := &pageWalker{
+		file:    file,
+		size:    uint64(fileInfo.Size()),
+		visited: make(map[uint64]bool),
+	}
+
+	// bolt takes the page size from the first meta, if it is valid
+	meta0, err := w.readMeta(0, uint64(os.Getpagesize()))
+	if err == nil {
+		w.pageSize = uint64(boltByteOrder.Uint32(meta0[8:12]))
+	} else {
+		w.pageSize = uint64(os.Getpagesize())
+	}
+	if w.pageSize < boltPageHeaderSize+boltMetaSize || w.size < 2*w.pageSize {
+		return fmt.Errorf("bolt pages: file size %d too small for page size %d", w.size, w.pageSize)
+	}
+	meta1, err1 := w.readMeta(1, w.pageSize)
+
+	// and uses the valid meta with the highest txid
+	meta := meta0
+	if err1 == nil && (err != nil ||
+		boltByteOrder.Uint64(meta1[48:56]) > boltByteOrder.Uint64(meta0[48:56])) {
+		meta = meta1
+	} else if err != nil {
+		return fmt.Errorf("bolt pages: invalid meta pages: %v, %v", err, err1)
+	}
+	w.pgid = boltByteOrder.Uint64(meta[40:48])
+	if w.pgid > w.size/w.pageSize {
+		return fmt.Errorf("bolt pages: high water mark %d beyond end of file", w.pgid)
+	}
+
+	err = w.checkFreelist(boltByteOrder.Uint64(meta[32:40]))
+	if err != nil {
+		return fmt.Errorf("bolt pages: %v", err)
+	}
+	err = w.checkBucket(boltByteOrder.Uint64(meta[16:24]), nil)
+	if err != nil {
+		return fmt.Errorf("bolt pages: %v", err)
+	}
+	return nil
+}
+
+// readMeta returns the meta in page id, if it is valid
+func (w *pageWalker) readMeta(id, pageSize uint64) ([]byte, error) {
+	meta := make([]byte, boltMetaSize)
+	_, err := w.file.ReadAt(meta, int64(id*pageSize+boltPageHeaderSize))
+	if err != nil {
+		return nil, fmt.Errorf("meta %d: %v", id, err)
+	}
+	if boltByteOrder.Uint32(meta[0:4]) != boltMagic {
+		return nil, fmt.Errorf("meta %d: invalid magic", id)
+	}
+	if boltByteOrder.Uint32(meta[4:8]) != boltVersion {
+		return nil, fmt.Errorf("meta %d: unsupported version", id)
+	}
+	checksum := boltByteOrder.Uint64(meta[boltMetaChecksumOff:])
+	h := fnv.New64a()
+	_, _ = h.Write(meta[:boltMetaChecksumOff])
+	if checksum != 0 && checksum != h.Sum64() {
+		return nil, fmt.Errorf("meta %d: checksum mismatch", id)
+	}
+	return meta, nil
+}
+
+// readPage reads page id and its overflow pages
+func (w *pageWalker) readPage(id uint64) ([]byte, error) {
+	if id < 2 || id >= w.pgid {
+		return nil, fmt.Errorf("page %d: outside of 2 to high water mark %d", id, w.pgid)
+	}
+	header := make([]byte, boltPageHeaderSize)
+	_, err := w.file.ReadAt(header, int64(id*w.pageSize))
+	if err != nil {
+		return nil, fmt.Errorf("page %d: %v", id, err)
+	}
+	if boltByteOrder.Uint64(header[0:8]) != id {
+		return nil, fmt.Errorf("page %d: header has id %d", id, boltByteOrder.Uint64(header[0:8]))
+	}
+	overflow := uint64(boltByteOrder.Uint32(header[12:16]))
+	if id+overflow >= w.pgid {
+		return nil, fmt.Errorf("page %d: overflow %d past high water mark %d", id, overflow, w.pgid)
+	}
+	for i := id; i <= id+overflow; i++ {
+		if w.visited[i] {
+			return nil, fmt.Errorf("page %d: reached more than once", i)
+		}
+		w.visited[i] = true
+	}
+	page := make([]byte, (overflow+1)*w.pageSize)
+	_, err = w.file.ReadAt(page, int64(id*w.pageSize))
+	if err != nil {
+		return nil, fmt.Errorf("page %d: %v", id, err)
+	}
+	return page, nil
+}
+
+func (w *pageWalker) checkFreelist(id uint64) error {
+	page, err := w.readPage(id)
+	if err != nil {
+		return err
+	}
+	if boltByteOrder.Uint16(page[8:10]) != boltFreelistPageFlag {
+		return fmt.Errorf("page %d: expected freelist", id)
+	}
+	// a count of 0xFFFF means the count is in the first element instead
+	start, end := uint64(0), uint64(boltByteOrder.Uint16(page[10:12]))
+	if end == 0xFFFF {
+		start, end = 1, boltByteOrder.Uint64(page[boltPageHeaderSize:])
+		if end < start {
+			return fmt.Errorf("page %d: invalid freelist count %d", id, end)
+		}
+	}
+	if end > uint64(len(page)-boltPageHeaderSize)/8 {
+		return fmt.Errorf("page %d: freelist count %d overflows page", id, end)
+	}
+	for i := start; i < end; i++ {
+		freeID := boltByteOrder.Uint64(page[boltPageHeaderSize+8*i:])
+		if freeID < 2 || freeID >= w.pgid {
+			return fmt.Errorf("page %d: free page %d outside of 2 to high water mark %d", id, freeID, w.pgid)
+		}
+	}
+	return nil
+}
+
+// checkBucket checks the bucket with its root at page id, or if id is 0,
+// the bucket inline in its parent
+func (w *pageWalker) checkBucket(id uint64, inline []byte) error {
+	if id == 0 {
+		if len(inline) < boltPageHeaderSize {
+			return fmt.Errorf("inline bucket too short: %d bytes", len(inline))
+		}
+		if boltByteOrder.Uint16(inline[8:10]) != boltLeafPageFlag {
+			return fmt.Errorf("inline bucket is not a leaf")
+		}
+		return w.checkPage(0, inline)
+	}
+	page, err := w.readPage(id)
+	if err != nil {
+		return err
+	}
+	return w.checkPage(id, page)
+}
+
+// checkPage checks that the elements of a branch or leaf page lie within it,
+// and then the pages and buckets they refer to
+func (w *pageWalker) checkPage(id uint64, page []byte) error {
+	flags := boltByteOrder.Uint16(page[8:10])
+	count := uint64(boltByteOrder.Uint16(page[10:12]))
+	size := uint64(len(page))
+	if flags != boltBranchPageFlag && flags != boltLeafPageFlag {
+		return fmt.Errorf("page %d: unexpected flags %02x", id, flags)
+	}
+	if flags == boltBranchPageFlag && count == 0 {
+		return fmt.Errorf("page %d: empty branch", id)
+	}
+	if boltPageHeaderSize+count*boltElementSize > size {
+		return fmt.Errorf("page %d: %d elements overflow page", id, count)
+	}
+	for i := uint64(0); i < count; i++ {
+		off := boltPageHeaderSize + i*boltElementSize
+		element := page[off : off+boltElementSize]
+		if flags == boltBranchPageFlag {
+			pos := uint64(boltByteOrder.Uint32(element[0:4]))
+			ksize := uint64(boltByteOrder.Uint32(element[4:8]))
+			if off+pos+ksize > size {
+				return fmt.Errorf("page %d: branch element %d overflows page", id, i)
+			}
+			childID := boltByteOrder.Uint64(element[8:16])
+			child, err := w.readPage(childID)
+			if err != nil {
+				return err
+			}
+			err = w.checkPage(childID, child)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		elementFlags := boltByteOrder.Uint32(element[0:4])
+		pos := uint64(boltByteOrder.Uint32(element[4:8]))
+		ksize := uint64(boltByteOrder.Uint32(element[8:12]))
+		vsize := uint64(boltByteOrder.Uint32(element[12:16]))
+		if off+pos+ksize+vsize > size {
+			return fmt.Errorf("page %d: leaf element %d overflows page", id, i)
+		}
+		if elementFlags&boltBucketLeafFlag == 0 {
+			continue
+		}
+		value := page[off+pos+ksize : off+pos+ksize+vsize]
+		if len(value) < boltBucketHeaderSize {
+			return fmt.Errorf("page %d: bucket element %d too short", id, i)
+		}
+		err := w.checkBucket(boltByteOrder.Uint64(value[0:8]), value[boltBucketHeaderSize:])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
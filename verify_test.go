@@ -0,0 +1,230 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestCellarVerify(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, i*100, (i+1)*100)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = c.Verify(context.Background())
+	if err != nil {
+		t.Errorf("expected no verify error, got %v", err)
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// change a value behind the checksum's back
+	db, err := bolt.Open("test/cellar-0000000000000001", 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(mutationsBucketName).Put([]byte("k0000000000000000"), []byte("bitrot"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	err = c.Verify(context.Background())
+	verifyErr, ok := err.(*VerifyError)
+	if !ok {
+		t.Fatalf("expected *VerifyError, got %v", err)
+	}
+	if len(verifyErr.Corrupt) != 1 || verifyErr.Corrupt[0].Path != "test/cellar-0000000000000001" {
+		t.Errorf("expected only segment 1 to be corrupt, got %v", verifyErr)
+	}
+
+	// a cancelled context stops verification
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = c.Verify(ctx)
+	if err != context.Canceled {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestVerifySegmentSeqMismatch(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 0, 100)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = VerifySegment("test/cellar-0000000000000001")
+	if err != nil {
+		t.Errorf("expected no verify error, got %v", err)
+	}
+
+	// copy the segment to a filename with a different seq
+	data, err := ioutil.ReadFile("test/cellar-0000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("test/cellar-0000000000000002", data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = VerifySegment("test/cellar-0000000000000002")
+	if err == nil {
+		t.Errorf("expected verify error for mismatched seq, got nil")
+	}
+}
+
+// TestVerifySegmentRawCorruption flips and truncates the bytes of a segment
+// file, verify must report the corruption, never crash or hang
+func TestVerifySegmentRawCorruption(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		err := putKvPairs(tx, 0, 500)
+		if err != nil {
+			return err
+		}
+		return putKeyspaceKvPairs(tx.Keyspace("a"), 0, 10)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile("test/cellar-0000000000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bolt grows the file ahead of the pages in use, only corrupt those
+	var used, pageSize int
+	segment, err := openSegment("test", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = segment.View(func(tx *bolt.Tx) error {
+		used, pageSize = int(tx.Size()), tx.DB().Info().PageSize
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = segment.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// checkUnchanged fails unless a segment which passed verify still has
+	// exactly the original data, a flip in unused space goes unnoticed
+	checkUnchanged := func(what string) {
+		segment, err := openSegment("test", 1)
+		if err != nil {
+			t.Fatalf("%s: verified segment fails to open: %v", what, err)
+		}
+		defer segment.Close()
+		err = segment.View(func(tx *bolt.Tx) error {
+			i := 0
+			err := tx.Bucket(mutationsBucketName).ForEach(func(k, v []byte) error {
+				if !bytes.Equal(k, []byte(fmt.Sprintf("k%016x", i))) || !bytes.Equal(v, []byte(fmt.Sprintf("v%016x", i))) {
+					return fmt.Errorf("changed key %d: %s/%s", i, k, v)
+				}
+				i++
+				return nil
+			})
+			if err == nil && i != 500 {
+				err = fmt.Errorf("expected 500 keys, got %d", i)
+			}
+			return err
+		})
+		if err != nil {
+			t.Errorf("%s: undetected corruption: %v", what, err)
+		}
+	}
+
+	// every byte of the page headers and first elements, a sample of the rest
+	for off := 0; off < used; off++ {
+		if off%pageSize >= 64 && off%61 != 0 {
+			continue
+		}
+		corrupt := append([]byte{}, data...)
+		corrupt[off] ^= 0xff
+		err = ioutil.WriteFile("test/cellar-0000000000000001", corrupt, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = VerifySegment("test/cellar-0000000000000001")
+		if err == nil {
+			checkUnchanged(fmt.Sprintf("flip at %d", off))
+		}
+	}
+
+	for _, size := range []int{0, 100, pageSize, pageSize + 7, used / 2, used - 1} {
+		err = ioutil.WriteFile("test/cellar-0000000000000001", data[:size], 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = VerifySegment("test/cellar-0000000000000001")
+		if err == nil {
+			t.Errorf("expected verify error for segment truncated to %d bytes", size)
+		}
+	}
+}
@@ -0,0 +1,337 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+)
+
+// commits kept in the memtable are first appended to a write-ahead log,
+// next to the master db, so that they survive a crash before they are
+// flushed to a segment.  A commit is a Put or Delete record for each key it
+// wrote, followed by a commit marker, and is only acknowledged once all of
+// them are written (and synced, unless the durability is DurabilityNone).
+//
+// each record is a crc32 of its payload, the payload length, and the
+// payload: a record type, then for Put/Delete the uvarint key length, the
+// key and the value.  Records for a named keyspace have their own types,
+// and the uvarint keyspace name length and name before the key
+//
+// when the memtable starts a flush, the log is renamed to walFlushingName
+// and a new one started, once the flushed segment is on the root the old
+// log is removed.  Open replays whatever logs remain, records of a commit
+// without its marker (a torn write) are discarded, as is everything after
+// the first record which fails its checksum.
+
+const walName = "wal.log"
+const walFlushingName = "wal.flushing.log"
+
+const walHeaderLen = 8
+
+const (
+	walPut byte = iota + 1
+	walDelete
+	walCommit
+	walPutKeyspace
+	walDeleteKeyspace
+)
+
+// walFile is the subset of os.File used to append to the log
+type walFile interface {
+	WriteAt(b []byte, off int64) (n int, err error)
+	Truncate(size int64) error
+	Sync() error
+	Close() error
+}
+
+type wal struct {
+	path string
+	sync bool
+	file walFile
+	size int64
+	// err is set if a failed append could not be undone, the log can't
+	// be appended to safely any more
+	err error
+}
+
+func walPath(cellarPath, name string) string {
+	return fmt.Sprintf("%s%s%s", cellarPath, string(os.PathSeparator), name)
+}
+
+func openWAL(cellarPath string, durability Durability) (*wal, error) {
+	rv := &wal{
+		path: cellarPath,
+		sync: durability != DurabilityNone,
+	}
+	err := rv.open()
+	if err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// open opens the log, creating it if need be, a new log's directory entry is
+// synced before anything is appended, or acknowledged commits could be lost
+// with it
+func (w *wal) open() error {
+	path := walPath(w.path, walName)
+	_, err := os.Stat(path)
+	created := os.IsNotExist(err)
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("wal open: %v", err)
+	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("wal stat: %v", err)
+	}
+	if created && w.sync {
+		err = syncDir(w.path)
+		if err != nil {
+			_ = file.Close()
+			return fmt.Errorf("wal syncDir: %v", err)
+		}
+	}
+	w.file = file
+	w.size = fileInfo.Size()
+	return nil
+}
+
+func appendWALRecord(buf []byte, recordType byte, name string, key, val []byte) []byte {
+	var lenBuf [binary.MaxVarintLen64]byte
+	payload := []byte{recordType}
+	if recordType == walPutKeyspace || recordType == walDeleteKeyspace {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(name)))
+		payload = append(payload, lenBuf[:n]...)
+		payload = append(payload, name...)
+	}
+	if recordType != walCommit {
+		n := binary.PutUvarint(lenBuf[:], uint64(len(key)))
+		payload = append(payload, lenBuf[:n]...)
+		payload = append(payload, key...)
+		payload = append(payload, val...)
+	}
+	var header [walHeaderLen]byte
+	binary.BigEndian.PutUint32(header[0:4], crc32.Checksum(payload, checksumTable))
+	binary.BigEndian.PutUint32(header[4:8], uint32(len(payload)))
+	buf = append(buf, header[:]...)
+	return append(buf, payload...)
+}
+
+// append writes the keys of the run to the log as one commit, if it fails,
+// the log is left as it was
+func (w *wal) append(run *memRun) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.file == nil {
+		// closed with the cellar
+		return ErrTxClosed
+	}
+	var buf []byte
+	for _, kv := range run.mutations {
+		buf = appendWALRecord(buf, walPut, "", kv.key, kv.val)
+	}
+	for _, kv := range run.deletions {
+		buf = appendWALRecord(buf, walDelete, "", kv.key, nil)
+	}
+	for _, name := range run.keyspaceNames() {
+		for _, kv := range run.keyspaces[name].mutations {
+			buf = appendWALRecord(buf, walPutKeyspace, name, kv.key, kv.val)
+		}
+		for _, kv := range run.keyspaces[name].deletions {
+			buf = appendWALRecord(buf, walDeleteKeyspace, name, kv.key, nil)
+		}
+	}
+	buf = appendWALRecord(buf, walCommit, "", nil, nil)
+
+	_, err := w.file.WriteAt(buf, w.size)
+	if err == nil && w.sync {
+		err = w.file.Sync()
+	}
+	if err != nil {
+		// remove anything partly written, so later commits follow on from
+		// the last good one
+		terr := w.file.Truncate(w.size)
+		if terr != nil {
+			w.err = fmt.Errorf("wal truncate after failed append: %v", terr)
+		}
+		return fmt.Errorf("wal append: %v", err)
+	}
+	w.size += int64(len(buf))
+	return nil
+}
+
+// rotate moves the current log aside, it holds exactly the commits about
+// to be flushed, later commits go to a new log
+func (w *wal) rotate() error {
+	if w.err != nil {
+		return w.err
+	}
+	err := w.file.Close()
+	if err != nil {
+		return fmt.Errorf("wal close: %v", err)
+	}
+	err = os.Rename(walPath(w.path, walName), walPath(w.path, walFlushingName))
+	if err != nil {
+		w.err = fmt.Errorf("wal rename: %v", err)
+		return w.err
+	}
+	// open syncs the directory for the new log, which makes the rename
+	// durable too
+	err = w.open()
+	if err != nil {
+		w.err = err
+		return err
+	}
+	return nil
+}
+
+// flushed removes the log moved aside by rotate, once its commits are in
+// a segment on the root
+func (w *wal) flushed() error {
+	err := os.Remove(walPath(w.path, walFlushingName))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("wal remove: %v", err)
+	}
+	return nil
+}
+
+func (w *wal) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// readWAL replays the logs in the cellar directory, returning the net
+// effect of every complete commit in them, oldest first
+func readWAL(cellarPath string) (*memBuffer, error) {
+	rv := newMemBuffer()
+	for _, name := range []string{walFlushingName, walName} {
+		buf, err := ioutil.ReadFile(walPath(cellarPath, name))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("wal read %s: %v", name, err)
+		}
+		err = applyWAL(buf, rv)
+		if err != nil {
+			return nil, fmt.Errorf("wal replay %s: %v", name, err)
+		}
+	}
+	return rv, nil
+}
+
+// applyWAL applies each complete commit in buf to buffer, it stops at the
+// first incomplete or corrupt record
+func applyWAL(buf []byte, buffer *memBuffer) error {
+	type op struct {
+		recordType byte
+		name       string
+		key, val   []byte
+	}
+	var pending []op
+	for len(buf) >= walHeaderLen {
+		checksum := binary.BigEndian.Uint32(buf[0:4])
+		length := binary.BigEndian.Uint32(buf[4:8])
+		if uint64(len(buf)-walHeaderLen) < uint64(length) {
+			break
+		}
+		payload := buf[walHeaderLen : walHeaderLen+int(length)]
+		if len(payload) == 0 || crc32.Checksum(payload, checksumTable) != checksum {
+			break
+		}
+		buf = buf[walHeaderLen+int(length):]
+		o := op{recordType: payload[0]}
+		if o.recordType == walCommit {
+			for _, o := range pending {
+				var err error
+				keyspace := buffer.forKeyspace(o.name)
+				if o.recordType == walPut || o.recordType == walPutKeyspace {
+					err = keyspace.Put(o.key, o.val)
+				} else {
+					err = keyspace.Delete(o.key)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			pending = pending[:0]
+			continue
+		} else if o.recordType < walPut || o.recordType > walDeleteKeyspace {
+			break
+		}
+		payload = payload[1:]
+		if o.recordType == walPutKeyspace || o.recordType == walDeleteKeyspace {
+			var name []byte
+			name, payload = walField(payload)
+			if name == nil {
+				break
+			}
+			o.name = string(name)
+		}
+		o.key, o.val = walField(payload)
+		if o.key == nil {
+			break
+		}
+		pending = append(pending, o)
+	}
+	return nil
+}
+
+// walField splits a uvarint length prefixed field from the front of
+// payload, returning a nil field if it is malformed
+func walField(payload []byte) (field []byte, rest []byte) {
+	fieldLen, n := binary.Uvarint(payload)
+	if n <= 0 || uint64(len(payload)-n) < fieldLen {
+		return nil, nil
+	}
+	return payload[n : n+int(fieldLen)], payload[n+int(fieldLen):]
+}
+
+// replayWAL writes the commits left in the logs by a crash to a new segment
+// on the root, and removes the logs
+func (c *Cellar) replayWAL() error {
+	buffer, err := readWAL(c.path)
+	if err != nil {
+		return err
+	}
+	run := buffer.commitRun()
+	if !run.empty() {
+		Logger.Printf("replaying %d bytes of commits from wal", run.size)
+		newsegment, err := c.buildRunSegment(run)
+		if err != nil {
+			return err
+		}
+		err = c.pushRoot(newsegment)
+		if err != nil {
+			removeSegments(segmentList{newsegment})
+			return err
+		}
+	}
+	for _, name := range []string{walFlushingName, walName} {
+		err = os.Remove(walPath(c.path, name))
+		if err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("wal remove: %v", err)
+		}
+	}
+	return nil
+}
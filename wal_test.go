@@ -0,0 +1,287 @@
+//  Copyright (c) 2016 Couchbase, Inc.
+//
+//  Licensed under the Apache License, Version 2.0 (the "License");
+//  you may not use this file except in compliance with the
+//  License. You may obtain a copy of the License at
+//    http://www.apache.org/licenses/LICENSE-2.0
+//  Unless required by applicable law or agreed to in writing,
+//  software distributed under the License is distributed on an "AS
+//  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+//  express or implied. See the License for the specific language
+//  governing permissions and limitations under the License.
+
+package cellar
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// crash closes the cellar without flushing the memtable, as if the process
+// had exited, leaving the wal to be replayed by the next Open
+func crash(t *testing.T, c *Cellar) {
+	c.commitLock.Lock()
+	c.rootLock.Lock()
+	c.memtable = &memtable{}
+	c.rootLock.Unlock()
+	c.commitLock.Unlock()
+	err := c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWALReplay(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", memtableOptions(1<<30, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		return putKvPairs(tx, 0, 10)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// these commits are flushed, and their log removed
+	err = c.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Update(func(tx *Tx) error {
+		err := putKvPairs(tx, 10, 20)
+		if err != nil {
+			return err
+		}
+		return tx.Delete([]byte(fmt.Sprintf("k%016x", 0)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(t, c)
+
+	c, err = Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.View(func(tx *Tx) error {
+		checkNoKey(t, tx, fmt.Sprintf("k%016x", 0))
+		checkCursor(t, tx, fmt.Sprintf("k%016x", 1), fmt.Sprintf("v%016x", 1),
+			fmt.Sprintf("k%016x", 19), fmt.Sprintf("v%016x", 19), 19)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the replayed commits are now in a segment, and the log is gone
+	if n := countSegments(c); n != 2 {
+		t.Errorf("expected 2 segments, got %d", n)
+	}
+	_, err = os.Stat(walPath("test", walName))
+	if !os.IsNotExist(err) {
+		t.Errorf("expected wal to be removed after replay, got %v", err)
+	}
+}
+
+// TestWALReplayTorn crashes with the log cut off at every possible offset,
+// and checks that exactly the commits complete by then are replayed
+func TestWALReplayTorn(t *testing.T) {
+	defer os.RemoveAll("test")
+
+	c, err := Open("test", memtableOptions(1<<30, time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// ends[i] is the length of the log once commit i is acknowledged
+	var ends []int64
+	for i := 0; i < 3; i++ {
+		err = c.Update(func(tx *Tx) error {
+			return putKvPairs(tx, 2*i, 2*i+2)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ends = append(ends, c.wal.size)
+	}
+	crash(t, c)
+	log, err := ioutil.ReadFile(walPath("test", walName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(log)) != ends[len(ends)-1] {
+		t.Fatalf("expected wal of %d bytes, got %d", ends[len(ends)-1], len(log))
+	}
+
+	for cut := 0; cut <= len(log); cut++ {
+		committed := 0
+		for committed < len(ends) && ends[committed] <= int64(cut) {
+			committed++
+		}
+		func() {
+			_ = os.RemoveAll("test")
+			err := os.MkdirAll("test", 0700)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = ioutil.WriteFile(walPath("test", walName), log[:cut], 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c, err := Open("test", testOptionsNoAutoMerge)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			err = c.View(func(tx *Tx) error {
+				for i := 0; i < 2*len(ends); i++ {
+					if i < 2*committed {
+						checkKey(t, tx, fmt.Sprintf("k%016x", i), fmt.Sprintf("v%016x", i))
+					} else {
+						checkNoKey(t, tx, fmt.Sprintf("k%016x", i))
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}()
+	}
+
+	// a corrupt record ends the replay, even if complete commits follow
+	corrupt := append([]byte{}, log...)
+	corrupt[ends[0]+walHeaderLen] ^= 0xff
+	_ = os.RemoveAll("test")
+	err = os.MkdirAll("test", 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(walPath("test", walName), corrupt, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err = Open("test", testOptionsNoAutoMerge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.View(func(tx *Tx) error {
+		checkCursor(t, tx, fmt.Sprintf("k%016x", 0), fmt.Sprintf("v%016x", 0),
+			fmt.Sprintf("k%016x", 1), fmt.Sprintf("v%016x", 1), 2)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+var errInjected = errors.New("injected fault")
+
+// faultyFile fails the write or sync of the failAt'th append, a failed
+// write only writes the first half of its bytes, like a torn write
+type faultyFile struct {
+	walFile
+	failAt       int
+	failSync     bool
+	failTruncate bool
+	appends      int
+}
+
+func (f *faultyFile) WriteAt(b []byte, off int64) (int, error) {
+	f.appends++
+	if f.appends == f.failAt && !f.failSync {
+		n, _ := f.walFile.WriteAt(b[:len(b)/2], off)
+		return n, errInjected
+	}
+	return f.walFile.WriteAt(b, off)
+}
+
+func (f *faultyFile) Sync() error {
+	if f.appends == f.failAt && f.failSync {
+		return errInjected
+	}
+	return f.walFile.Sync()
+}
+
+func (f *faultyFile) Truncate(size int64) error {
+	if f.failTruncate {
+		return errInjected
+	}
+	return f.walFile.Truncate(size)
+}
+
+func TestWALFaultInjection(t *testing.T) {
+	tests := []struct {
+		name         string
+		failSync     bool
+		failTruncate bool
+	}{
+		{"torn write", false, false},
+		{"failed sync", true, false},
+		{"torn write, failed truncate", false, true},
+	}
+	for _, test := range tests {
+		for failAt := 1; failAt <= 5; failAt++ {
+			func() {
+				defer os.RemoveAll("test")
+
+				c, err := Open("test", memtableOptions(1<<30, time.Hour))
+				if err != nil {
+					t.Fatal(err)
+				}
+				c.wal.file = &faultyFile{
+					walFile:      c.wal.file,
+					failAt:       failAt,
+					failSync:     test.failSync,
+					failTruncate: test.failTruncate,
+				}
+
+				acknowledged := make(map[int]bool)
+				for i := 0; i < 5; i++ {
+					err = c.Update(func(tx *Tx) error {
+						return putKvPairs(tx, 2*i, 2*i+2)
+					})
+					if err == nil {
+						acknowledged[i] = true
+					} else if i+1 != failAt && !test.failTruncate {
+						// only the failed commit, or every later one if the
+						// log could not be repaired, should fail
+						t.Errorf("%s at %d: unexpected error in commit %d: %v", test.name, failAt, i, err)
+					}
+				}
+				if acknowledged[failAt-1] {
+					t.Errorf("%s at %d: expected injected fault to fail the commit", test.name, failAt)
+				}
+				crash(t, c)
+
+				c, err = Open("test", testOptionsNoAutoMerge)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer c.Close()
+				err = c.View(func(tx *Tx) error {
+					for i := 0; i < 5; i++ {
+						for j := 2 * i; j < 2*i+2; j++ {
+							key := fmt.Sprintf("k%016x", j)
+							if acknowledged[i] {
+								checkKey(t, tx, key, fmt.Sprintf("v%016x", j))
+							} else if i+1 == failAt {
+								checkNoKey(t, tx, key)
+							}
+						}
+					}
+					return nil
+				})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}()
+		}
+	}
+}